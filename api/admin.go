@@ -0,0 +1,199 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/api/middleware"
+	"github.com/jswirl/miit/config"
+	"github.com/jswirl/miit/logging"
+)
+
+// Scopes of admin API keys. Read-only keys may inspect miitings, operators
+// may also manage them.
+const (
+	adminScopeReadOnly = "read-only"
+	adminScopeOperator = "operator"
+)
+
+// adminKey is an API key granting access to the admin API. Only the digest of
+// the key is kept.
+type adminKey struct {
+	name   string
+	scope  string
+	digest []byte
+}
+
+// Admin authentication errors.
+var errAdminKeyMissing = errors.New("missing API key")
+var errAdminKeyInvalid = errors.New("invalid API key")
+var errAdminKeyScope = errors.New("insufficient API key scope")
+
+// The admin API router, group and configurations. The admin API is served by
+// its own router if it has its own listener, or by the global router.
+var adminRouter *gin.Engine
+var adminGroup *gin.RouterGroup
+var adminOnce sync.Once
+var adminAddress string
+var adminKeys []adminKey
+
+// auditLogger logs the access to the admin API.
+var auditLogger, _ = logging.NewLogger("audit")
+
+// GetAdminRouter returns the router serving the admin API on its own
+// listener, or nil if it's served by the global router.
+func GetAdminRouter() *gin.Engine {
+	// Initialize admin API singleton instances.
+	adminOnce.Do(initializeAdmin)
+	return adminRouter
+}
+
+// GetAdminAddress returns the loopback address the admin API listens on, or
+// an empty string if it's served by the global router.
+func GetAdminAddress() string {
+	// Initialize admin API singleton instances.
+	adminOnce.Do(initializeAdmin)
+	return adminAddress
+}
+
+// getAdminGroup returns the router group of the admin API.
+func getAdminGroup() *gin.RouterGroup {
+	// Initialize admin API singleton instances.
+	adminOnce.Do(initializeAdmin)
+	return adminGroup
+}
+
+// initializeAdmin is the function called by sync.Once to load the admin API
+// configurations and to initialize its router group.
+func initializeAdmin() {
+	// Load configuration values.
+	var err error
+	adminKeys, err = parseAdminKeys(config.GetString("MIIT_ADMIN_KEYS"))
+	if err != nil {
+		panic(err)
+	}
+	adminAddress = config.GetString("MIIT_ADMIN_LISTEN_ADDRESS")
+	if len(adminAddress) <= 0 {
+		adminGroup = GetRoot().Group("admin",
+			middleware.RateLimit(adminLimiter))
+		return
+	}
+
+	// Only serve the admin API on its own listener if it's loopback-only.
+	if !addressIsLoopback(adminAddress) {
+		panic(fmt.Errorf("admin listen address is not loopback: [%s]",
+			adminAddress))
+	}
+	var root *gin.RouterGroup
+	adminRouter, root = createRouterAndGroup("")
+	adminGroup = root.Group("admin", middleware.RateLimit(adminLimiter))
+}
+
+// authorizeAdmin returns a handler authorizing admin requests made with an API
+// key of the given scope. Denied requests are audit-logged, as well as the
+// requests of operators.
+func authorizeAdmin(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Authenticate the key and check its scope.
+		key, err := authenticateAdmin(ctx)
+		status := http.StatusUnauthorized
+		if err == nil && !scopeAllows(key.scope, scope) {
+			err, status = errAdminKeyScope, http.StatusForbidden
+		}
+		if err != nil {
+			auditLogger.Warn("Denied admin request [%s %s] from [%s]: %v",
+				ctx.Request.Method, ctx.Request.URL.Path, ctx.ClientIP(), err)
+			if status == http.StatusUnauthorized {
+				ctx.Header("WWW-Authenticate", bearerScheme)
+			}
+			abortWithStatusAndMessage(ctx, status,
+				"Access to admin API is forbidden: %v", err)
+			return
+		}
+
+		// Keep track of what operators do.
+		if key.scope == adminScopeOperator {
+			auditLogger.Info("Admin request [%s %s] from [%s] by [%s]",
+				ctx.Request.Method, ctx.Request.URL.Path, ctx.ClientIP(),
+				key.name)
+		}
+	}
+}
+
+// authenticateAdmin returns the admin key presented with the request, in the
+// X-Api-Key header or as bearer credentials.
+func authenticateAdmin(ctx *gin.Context) (*adminKey, error) {
+	// Get the key from request headers.
+	presented := ctx.GetHeader("X-Api-Key")
+	if len(presented) <= 0 {
+		presented = bearerCredentials(ctx)
+	}
+	if len(presented) <= 0 {
+		return nil, errAdminKeyMissing
+	}
+
+	// Compare the digests of all keys, so the time taken doesn't tell which
+	// one matched.
+	digest := sha256.Sum256([]byte(presented))
+	var found *adminKey
+	for idx := range adminKeys {
+		if subtle.ConstantTimeCompare(digest[:], adminKeys[idx].digest) == 1 {
+			found = &adminKeys[idx]
+		}
+	}
+	if found == nil {
+		return nil, errAdminKeyInvalid
+	}
+
+	return found, nil
+}
+
+// scopeAllows checks if a key of the given scope may make requests requiring
+// the other scope. Operators may make read-only requests too.
+func scopeAllows(scope string, required string) bool {
+	return scope == required || scope == adminScopeOperator
+}
+
+// parseAdminKeys parses a comma separated list of admin keys, each given as
+// its name, scope and key separated by colons.
+func parseAdminKeys(value string) ([]adminKey, error) {
+	keys := []adminKey{}
+	if len(strings.TrimSpace(value)) <= 0 {
+		return keys, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(fields) != 3 || len(fields[0]) <= 0 || len(fields[2]) <= 0 ||
+			(fields[1] != adminScopeReadOnly &&
+				fields[1] != adminScopeOperator) {
+			return nil, fmt.Errorf("invalid admin key: [%s]", fields[0])
+		}
+		digest := sha256.Sum256([]byte(fields[2]))
+		keys = append(keys,
+			adminKey{name: fields[0], scope: fields[1], digest: digest[:]})
+	}
+
+	return keys, nil
+}
+
+// addressIsLoopback checks if the listen address is on a loopback interface.
+func addressIsLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -77,12 +77,38 @@ func installCommonMiddleware(group *gin.RouterGroup) {
 
 // Abort request processing and respond with error message.
 func abortWithStatusAndMessage(ctx *gin.Context, status int,
+	format string, arguments ...interface{}) {
+	abortWithStatusAndDetails(ctx, status, nil, format, arguments...)
+}
+
+// Abort request processing and respond with error message, along with details
+// for the client to act upon.
+func abortWithStatusAndDetails(ctx *gin.Context, status int, details gin.H,
 	format string, arguments ...interface{}) {
 	logger := middleware.GetLogger(ctx)
 	message := fmt.Sprintf(format, arguments...)
-	ctx.AbortWithStatusJSON(status, gin.H{
+	response := gin.H{
 		"error":      message,
 		"request_id": middleware.GetRequestID(ctx),
-	})
+	}
+	for key, value := range details {
+		response[key] = value
+	}
+	ctx.AbortWithStatusJSON(status, response)
 	logger.Error(message)
 }
+
+// routeByParam returns a handler dispatching requests to one of the routes
+// keyed by the value of the given path parameter, or to fallback if none of
+// them matches. The router cannot register static path segments alongside a
+// wildcard segment at the same position, so this is how we share them.
+func routeByParam(param string, routes map[string]gin.HandlerFunc,
+	fallback gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if handler, exists := routes[ctx.Param(param)]; exists {
+			handler(ctx)
+			return
+		}
+		fallback(ctx)
+	}
+}
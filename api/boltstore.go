@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The bucket holding miiting records in bolt databases.
+var miitingsBucket = []byte("miitings")
+
+// boltStore is the miiting store persisting miiting metadata and participant
+// slots in an embedded bolt database, so they survive restarts. Live miitings
+// are kept in memory as well. Heartbeats are only persisted every so often,
+// as they arrive with every keep-alive of every participant.
+type boltStore struct {
+	*memoryStore
+	db     *bolt.DB
+	mutex  sync.Mutex
+	synced map[string]int64
+}
+
+// openBoltStore opens the bolt miiting store in the file at the given path,
+// restoring the miitings persisted in it.
+func openBoltStore(path string) (*boltStore, error) {
+	// Open the database, giving up if another instance is holding it.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &boltStore{
+		memoryStore: newMemoryStore(),
+		db:          db,
+		synced:      map[string]int64{},
+	}
+
+	// Restore all persisted miitings into memory.
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(miitingsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(key, value []byte) error {
+			record := miitingRecord{}
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			store.memoryStore.Create(restoreMiiting(&record))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Create implements MiitingStore.
+func (store *boltStore) Create(miiting *miiting) (*miiting, bool, error) {
+	stored, exists, _ := store.memoryStore.Create(miiting)
+	if exists {
+		return stored, true, nil
+	}
+
+	// Forget the miiting again if we fail to persist it.
+	if err := store.save(stored); err != nil {
+		store.memoryStore.Delete(stored.ID)
+		return nil, false, err
+	}
+
+	return stored, false, nil
+}
+
+// Join implements MiitingStore.
+func (store *boltStore) Join(miiting *miiting, token string,
+	participant *participant) error {
+	store.memoryStore.Join(miiting, token, participant)
+	return store.write(miiting, recordMiiting(miiting))
+}
+
+// Leave implements MiitingStore.
+func (store *boltStore) Leave(miiting *miiting, token string) error {
+	store.memoryStore.Leave(miiting, token)
+	return store.write(miiting, recordMiiting(miiting))
+}
+
+// Update implements MiitingStore.
+func (store *boltStore) Update(miiting *miiting) error {
+	return store.save(miiting)
+}
+
+// UpdateHeartbeat implements MiitingStore.
+func (store *boltStore) UpdateHeartbeat(miiting *miiting, token string,
+	timestamp int64) error {
+	store.memoryStore.UpdateHeartbeat(miiting, token, timestamp)
+
+	// Skip persisting the heartbeat if the miiting was persisted recently
+	// enough, restored participants then have at least half the keep-alive
+	// timeout left to reconnect.
+	store.mutex.Lock()
+	synced := store.synced[miiting.ID]
+	store.mutex.Unlock()
+	if timestamp-synced < keepAliveTimeoutNanoseconds/2 {
+		return nil
+	}
+
+	return store.save(miiting)
+}
+
+// Delete implements MiitingStore.
+func (store *boltStore) Delete(miitingID string) error {
+	store.memoryStore.Delete(miitingID)
+	return store.db.Update(func(tx *bolt.Tx) error {
+		store.mutex.Lock()
+		delete(store.synced, miitingID)
+		store.mutex.Unlock()
+		return tx.Bucket(miitingsBucket).Delete([]byte(miitingID))
+	})
+}
+
+// save persists the current record of the miiting, unless it's been deleted.
+func (store *boltStore) save(saved *miiting) error {
+	saved.mutex.Lock()
+	record := recordMiiting(saved)
+	saved.mutex.Unlock()
+
+	return store.write(saved, record)
+}
+
+// write persists the record of the miiting, unless it's been deleted.
+func (store *boltStore) write(saved *miiting, record *miitingRecord) error {
+	timestamp := time.Now().UnixNano()
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Check the miiting is still stored within the transaction, as deletes
+	// remove miitings from memory before their records, a record deleted
+	// concurrently is never written back.
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if stored, exists := store.memoryStore.Load(saved.ID); !exists ||
+			stored != saved {
+			return nil
+		}
+		store.mutex.Lock()
+		store.synced[saved.ID] = timestamp
+		store.mutex.Unlock()
+		return tx.Bucket(miitingsBucket).Put([]byte(saved.ID), value)
+	})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Candidate error types to signal candidates were sent after the
+// end-of-candidates, or beyond the maximum number of candidates of a queue.
+var errCandidatesCompleted = errors.New("ICE candidates already completed")
+var errTooManyCandidates = errors.New("too many ICE candidates")
+
+// candidateQueue is the append-only queue of ICE candidates trickled by one
+// side of a negotiation. Candidates are numbered by their position in the
+// queue, so receivers can keep a cursor of how many they have seen so far.
+type candidateQueue struct {
+	mutex      sync.Mutex
+	candidates []interface{}
+	completed  bool
+	updated    chan struct{}
+}
+
+// newCandidateQueue creates an empty candidate queue.
+func newCandidateQueue() *candidateQueue {
+	return &candidateQueue{
+		candidates: []interface{}{},
+		updated:    make(chan struct{}),
+	}
+}
+
+// append adds candidates to the queue and marks it as completed if this was
+// the last of them, unless they'd exceed the maximum number of candidates.
+// Waiting receivers are woken up.
+func (queue *candidateQueue) append(candidates []interface{},
+	complete bool) (int, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	// Nothing can be added after the end-of-candidates marker, nor beyond the
+	// maximum number of candidates.
+	if queue.completed {
+		return len(queue.candidates), errCandidatesCompleted
+	} else if len(queue.candidates)+len(candidates) > maxIceCandidates {
+		return len(queue.candidates), errTooManyCandidates
+	}
+	queue.candidates = append(queue.candidates, candidates...)
+	queue.completed = complete
+
+	// Wake up all waiting receivers.
+	close(queue.updated)
+	queue.updated = make(chan struct{})
+
+	return len(queue.candidates), nil
+}
+
+// after returns the candidates after the cursor, whether the queue has been
+// completed, and a channel closed on the next update of the queue.
+func (queue *candidateQueue) after(cursor int) ([]interface{}, bool,
+	<-chan struct{}) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	// Copy the candidates so they can be used outside of the lock.
+	candidates := []interface{}{}
+	if cursor >= 0 && cursor < len(queue.candidates) {
+		candidates = append(candidates, queue.candidates[cursor:]...)
+	}
+
+	return candidates, queue.completed, queue.updated
+}
+
+// wait blocks until there are candidates after the cursor, the queue has been
+// completed, or the context is done.
+func (queue *candidateQueue) wait(ctx context.Context, cursor int) (
+	[]interface{}, bool, error) {
+	for {
+		candidates, completed, updated := queue.after(cursor)
+		if len(candidates) > 0 || completed {
+			return candidates, completed, nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
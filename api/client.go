@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/config"
+)
+
+// Client features which may be turned on or off by configuration.
+var clientFeatures = []string{
+	"file_transfer",
+	"notification_sound",
+}
+
+// Client configurations, delivered to clients so they may be tuned without
+// rebuilding the assets.
+var clientKeepAliveErrorThreshold int
+var clientPageReloadTimeout time.Duration
+var clientFileChunkSize int
+var clientFileBlockChunks int
+var clientFileBufferSize int
+var clientFileBackoff time.Duration
+var clientFeatureFlags map[string]bool
+
+func init() {
+	// Load configuration values.
+	clientKeepAliveErrorThreshold =
+		config.GetInt("MIIT_CLIENT_KEEPALIVE_ERROR_THRESHOLD")
+	clientPageReloadTimeout =
+		config.GetMilliseconds("MIIT_CLIENT_PAGE_RELOAD_TIMEOUT")
+	clientFileChunkSize = config.GetInt("MIIT_CLIENT_FILE_CHUNK_SIZE")
+	clientFileBlockChunks = config.GetInt("MIIT_CLIENT_FILE_BLOCK_CHUNKS")
+	clientFileBufferSize = config.GetInt("MIIT_CLIENT_FILE_BUFFER_SIZE")
+	clientFileBackoff = config.GetMilliseconds("MIIT_CLIENT_FILE_BACKOFF")
+	var err error
+	clientFeatureFlags, err = parseFeatureFlags(
+		config.GetString("MIIT_CLIENT_FEATURES"))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// GetClientConfig is the handler for clients requesting their configurations,
+// before they join a miiting. The ICE servers listed don't need credentials,
+// participants get TURN servers & credentials once they've joined.
+func GetClientConfig(ctx *gin.Context) {
+	servers := []iceServer{}
+	if len(stunURLs) > 0 {
+		servers = append(servers, iceServer{URLs: stunURLs})
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ice_servers":               servers,
+		"keepalive_interval":        milliseconds(keepAliveInterval),
+		"keepalive_error_threshold": clientKeepAliveErrorThreshold,
+		"page_reload_timeout":       milliseconds(clientPageReloadTimeout),
+		"file_chunk_size":           clientFileChunkSize,
+		"file_block_chunks":         clientFileBlockChunks,
+		"file_channel_buffer_size":  clientFileBufferSize,
+		"file_channel_backoff":      milliseconds(clientFileBackoff),
+		"features":                  clientFeatureFlags,
+	})
+}
+
+// milliseconds returns the duration in milliseconds.
+func milliseconds(duration time.Duration) int64 {
+	return int64(duration / time.Millisecond)
+}
+
+// parseFeatureFlags parses a comma separated list of enabled client features,
+// returning the flags of all client features.
+func parseFeatureFlags(value string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, feature := range clientFeatures {
+		flags[feature] = false
+	}
+
+	for _, feature := range strings.Split(value, ",") {
+		feature = strings.TrimSpace(feature)
+		if len(feature) <= 0 {
+			continue
+		} else if _, exists := flags[feature]; !exists {
+			return nil, fmt.Errorf("unknown client feature: [%s]", feature)
+		}
+		flags[feature] = true
+	}
+
+	return flags, nil
+}
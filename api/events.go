@@ -0,0 +1,195 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/logging"
+)
+
+// Types of events published to miiting participants.
+const (
+	eventTypePeerJoined          = "peer_joined"
+	eventTypePeerLeft            = "peer_left"
+	eventTypeLobbyUpdated        = "lobby_updated"
+	eventTypeKicked              = "kicked"
+	eventTypeHostChanged         = "host_changed"
+	eventTypeMiitingLocked       = "miiting_locked"
+	eventTypeOfferAvailable      = "offer_available"
+	eventTypeAnswerAvailable     = "answer_available"
+	eventTypeCandidatesAvailable = "ice_candidates_available"
+	eventTypeMiitingTimedOut     = "miiting_timed_out"
+	eventTypeMiitingDeleted      = "miiting_deleted"
+	eventTypeMiitingExpiring     = "miiting_expiring"
+	eventTypeMiitingExpired      = "miiting_expired"
+	eventTypeMiitingExtended     = "miiting_extended"
+	eventTypeKeepAlive           = "keepalive"
+)
+
+// The number of events buffered for each subscriber before it is considered
+// too slow and gets disconnected.
+const eventBufferSize = 32
+
+// event is a notification of a change in the state of a miiting.
+type event struct {
+	ID        int64       `json:"id"`
+	Type      string      `json:"type"`
+	From      string      `json:"from,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// eventHub fans out the events of a miiting to its subscribed participants,
+// who are identified by their participant IDs.
+type eventHub struct {
+	mutex       sync.Mutex
+	sequence    int64
+	closed      bool
+	subscribers map[chan *event]string
+}
+
+// newEventHub creates an event hub without any subscribers.
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan *event]string{}}
+}
+
+// subscribe registers a subscriber for the participant with the given ID.
+// The returned channel is closed when the hub is closed.
+func (hub *eventHub) subscribe(participantID string) chan *event {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	events := make(chan *event, eventBufferSize)
+	if hub.closed {
+		close(events)
+		return events
+	}
+	hub.subscribers[events] = participantID
+
+	return events
+}
+
+// unsubscribe removes a subscriber from the hub.
+func (hub *eventHub) unsubscribe(events chan *event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if _, exists := hub.subscribers[events]; exists {
+		delete(hub.subscribers, events)
+		close(events)
+	}
+}
+
+// publish sends an event to all subscribers except the source participant,
+// who caused the event in the first place.
+func (hub *eventHub) publish(source string, eventType string,
+	data interface{}) {
+	hub.deliver(func(participantID string) bool {
+		return len(source) <= 0 || participantID != source
+	}, source, eventType, data)
+}
+
+// publishTo sends an event from the source participant to the target only.
+func (hub *eventHub) publishTo(target string, source string,
+	eventType string, data interface{}) {
+	hub.deliver(func(participantID string) bool {
+		return participantID == target
+	}, source, eventType, data)
+}
+
+// deliver sends an event to all subscribers accepted by the filter.
+func (hub *eventHub) deliver(filter func(participantID string) bool,
+	source string, eventType string, data interface{}) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	// Assign the event its sequence number.
+	hub.sequence++
+	event := &event{
+		ID:        hub.sequence,
+		Type:      eventType,
+		From:      source,
+		Timestamp: time.Now().UnixNano(),
+		Data:      data,
+	}
+
+	// Deliver the event, dropping subscribers who can't keep up.
+	for events, participantID := range hub.subscribers {
+		if !filter(participantID) {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			logging.Warn("Dropping slow event subscriber [%s]", participantID)
+			delete(hub.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// close disconnects all subscribers, no events are published afterwards.
+func (hub *eventHub) close() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.closed = true
+	for events := range hub.subscribers {
+		delete(hub.subscribers, events)
+		close(events)
+	}
+}
+
+// StreamEvents is the handler streaming miiting events to a participant as
+// Server-Sent Events.
+func StreamEvents(ctx *gin.Context) {
+	// Extract parameters from request.
+	miiting, _, token, err := extractParameters(ctx, false)
+	if err != nil {
+		return
+	}
+
+	// Subscribe to the events of our miiting.
+	participant := getParticipant(miiting, token)
+	if participant == nil {
+		abortWithStatusAndMessage(ctx, http.StatusGone,
+			"Participant has left miiting [%s]", miiting.ID)
+		return
+	}
+	events := miiting.events.subscribe(participant.ID)
+	defer miiting.events.unsubscribe(events)
+
+	// Prevent caches and proxies from holding back our events.
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+
+	// Stream events until we leave the miiting or the client goes away.
+	ctx.Stream(func(writer io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			ctx.Render(-1, sse.Event{
+				Id:    strconv.FormatInt(event.ID, 10),
+				Event: event.Type,
+				Data:  event,
+			})
+		case <-time.After(keepAliveInterval):
+			ctx.Render(-1, sse.Event{
+				Event: eventTypeKeepAlive,
+				Data:  gin.H{},
+			})
+		case <-participant.ctx.Done():
+			return false
+		}
+
+		return true
+	})
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/logging"
+)
+
+func init() {
+	// Setup handlers for the host to moderate the miiting.
+	miitingsGroup := signalingGroup("miitings")
+	miitingsGroup.DELETE(":miiting/participants/:participant",
+		KickParticipant)
+	miitingsGroup.PUT(":miiting/lock", LockMiiting)
+	miitingsGroup.DELETE(":miiting/lock", UnlockMiiting)
+	miitingsGroup.PUT(":miiting/host", TransferHost)
+}
+
+// KickParticipant is the handler for the host kicking a participant out of
+// the miiting. The token of the participant is revoked, and new joiners from
+// its address have to be admitted by the host from the lobby, so it can't
+// rejoin as someone new either. Addresses may be shared behind NATs or
+// proxies, so they're only held in the lobby rather than turned away.
+func KickParticipant(ctx *gin.Context) {
+	// Extract parameters from request.
+	miiting, hostToken, err := extractHostParameters(ctx)
+	if err != nil {
+		return
+	}
+	host := getParticipant(miiting, hostToken)
+
+	// Find the token of the requested participant, the host can't kick itself.
+	participantID := ctx.Param("participant")
+	token, exists := findToken(miiting, participantID)
+	if !exists || token == hostToken {
+		abortWithStatusAndMessage(ctx, http.StatusNotFound,
+			"Failed to find participant [%s]", participantID)
+		return
+	}
+
+	// Revoke the token, let the participant know and remove it.
+	miiting.revoked.Store(token, true)
+	if participant := getParticipant(miiting, token); participant != nil &&
+		len(participant.clientIP) > 0 {
+		miiting.kicked.Store(participant.clientIP, true)
+	}
+	updateMiiting(miiting)
+	miiting.events.publishTo(participantID, host.ID, eventTypeKicked, nil)
+	removeParticipant(miiting, token, leaveReasonKicked)
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
+
+// LockMiiting is the handler for the host locking the miiting against new
+// joiners. Participants already in the miiting may still rejoin or resume.
+func LockMiiting(ctx *gin.Context) {
+	setLocked(ctx, true)
+}
+
+// UnlockMiiting is the handler for the host unlocking the miiting.
+func UnlockMiiting(ctx *gin.Context) {
+	setLocked(ctx, false)
+}
+
+// setLocked locks or unlocks the miiting requested by the host.
+func setLocked(ctx *gin.Context, locked bool) {
+	// Extract parameters from request.
+	miiting, hostToken, err := extractHostParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Update the miiting and let everyone know.
+	miiting.mutex.Lock()
+	miiting.Locked = locked
+	miiting.mutex.Unlock()
+	updateMiiting(miiting)
+	miiting.events.publish(getParticipant(miiting, hostToken).ID,
+		eventTypeMiitingLocked, gin.H{"locked": locked})
+
+	ctx.JSON(http.StatusOK, gin.H{"locked": locked})
+}
+
+// TransferHost is the handler for the host handing its rights to another
+// participant of the miiting.
+func TransferHost(ctx *gin.Context) {
+	// Extract parameters from request.
+	miiting, hostToken, err := extractHostParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Get the ID of the new host from request body.
+	body := struct {
+		Participant string `json:"participant"`
+	}{}
+	if err := ctx.BindJSON(&body); err != nil {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Failed to unmarshal host transfer request: %v", err)
+		return
+	}
+
+	// Make sure the new host is a participant of the miiting.
+	if _, exists := findToken(miiting, body.Participant); !exists {
+		abortWithStatusAndMessage(ctx, http.StatusNotFound,
+			"Failed to find participant [%s]", body.Participant)
+		return
+	}
+
+	// Hand over host rights and let everyone know.
+	miiting.mutex.Lock()
+	miiting.Host = body.Participant
+	miiting.mutex.Unlock()
+	updateMiiting(miiting)
+	miiting.events.publish(getParticipant(miiting, hostToken).ID,
+		eventTypeHostChanged, gin.H{"host": body.Participant})
+
+	ctx.JSON(http.StatusOK, gin.H{"host": body.Participant})
+}
+
+// extractHostParameters extracts common parameters from a request, making
+// sure it was made by the host of the miiting.
+func extractHostParameters(ctx *gin.Context) (*miiting, string, error) {
+	// Extract parameters from request.
+	miiting, _, token, err := extractParameters(ctx, false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Only the host is allowed to proceed.
+	if !isHost(miiting, token) {
+		abortWithStatusAndMessage(ctx, http.StatusForbidden,
+			"Only the host may manage miiting [%s]", miiting.ID)
+		return nil, "", errParameterExtractionFailed
+	}
+
+	return miiting, token, nil
+}
+
+// isHost checks if the participant with the given token hosts the miiting.
+func isHost(miiting *miiting, token string) bool {
+	participant := getParticipant(miiting, token)
+	if participant == nil {
+		return false
+	}
+
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+	return participant.ID == miiting.Host
+}
+
+// findToken returns the token of the participant with the given ID.
+func findToken(miiting *miiting, participantID string) (string, bool) {
+	var found string
+	exists := false
+	miiting.Tokens.Range(func(token, value interface{}) bool {
+		if value.(*participant).ID == participantID {
+			found, exists = token.(string), true
+			return false
+		}
+		return true
+	})
+
+	return found, exists
+}
+
+// updateMiiting persists changes to the metadata of the miiting.
+func updateMiiting(miiting *miiting) {
+	if err := store.Update(miiting); err != nil {
+		logging.Error("Failed to update miiting [%s]: %v", miiting.ID, err)
+	}
+}
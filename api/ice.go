@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/config"
+	"github.com/jswirl/miit/stun"
+)
+
+// iceServer is an ICE server offered to participants, as in the RTCIceServer
+// dictionary of WebRTC.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICE server configurations. TURN credentials are only issued if there's a
+// secret shared with the TURN servers.
+var stunURLs []string
+var turnURLs []string
+var turnSecret string
+var turnCredentialTTL time.Duration
+
+func init() {
+	// Load configuration values.
+	stunURLs = parseURLs(config.GetString("MIIT_STUN_URLS"))
+	turnURLs = parseURLs(config.GetString("MIIT_TURN_URLS"))
+	turnSecret = config.GetString("MIIT_TURN_SECRET")
+	turnCredentialTTL = config.GetMilliseconds("MIIT_TURN_CREDENTIAL_TTL")
+
+	// Setup handlers for admin module.
+	getAdminGroup().GET("stun", authorizeAdmin(adminScopeReadOnly),
+		GetSTUNStatistics)
+}
+
+// GetIceServers is the handler for participants requesting the ICE servers to
+// connect through, with short-lived credentials for the TURN servers.
+func GetIceServers(ctx *gin.Context) {
+	// Extract parameters from request.
+	miiting, _, token, err := extractParameters(ctx, false)
+	if err != nil {
+		return
+	}
+	participant := getParticipant(miiting, token)
+	if participant == nil {
+		abortWithStatusAndMessage(ctx, http.StatusUnauthorized,
+			"Unauthorized token for miiting [%s]", miiting.ID)
+		return
+	}
+
+	// Issue TURN credentials for the participant, if we can.
+	servers := []iceServer{}
+	if len(stunURLs) > 0 {
+		servers = append(servers, iceServer{URLs: stunURLs})
+	}
+	expiry := time.Now().Add(turnCredentialTTL)
+	if len(turnURLs) > 0 && len(turnSecret) > 0 {
+		username, password := stun.CreateCredential(turnSecret,
+			participant.ID, expiry)
+		servers = append(servers, iceServer{
+			URLs:       turnURLs,
+			Username:   username,
+			Credential: password,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ice_servers": servers,
+		"ttl":         int64(turnCredentialTTL / time.Second),
+		"expiry":      expiry.UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// GetSTUNStatistics returns the counters of the built-in STUN server.
+func GetSTUNStatistics(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"stun": stun.GetStatistics()})
+}
+
+// parseURLs parses a comma separated list of URLs.
+func parseURLs(value string) []string {
+	urls := []string{}
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Statuses of participants waiting in the lobby of a miiting.
+const (
+	lobbyStatusPending  = "pending"
+	lobbyStatusAdmitted = "admitted"
+	lobbyStatusRejected = "rejected"
+)
+
+// pendingParticipant is a joiner waiting in the lobby of a miiting for the
+// host to admit it. Admitted joiners keep their ID as participants.
+type pendingParticipant struct {
+	ID            string `json:"id"`
+	Name          string `json:"name,omitempty"`
+	JoinTimestamp int64  `json:"join_timestamp"`
+	Timestamp     int64  `json:"timestamp"`
+	Status        string `json:"status"`
+}
+
+func init() {
+	// Setup handlers for the host to admit or reject waiting joiners.
+	miitingsGroup := signalingGroup("miitings")
+	miitingsGroup.PUT(":miiting/lobby/:participant", AdmitParticipant)
+	miitingsGroup.DELETE(":miiting/lobby/:participant", RejectParticipant)
+}
+
+// ListLobby is the handler for the host listing the joiners in the lobby.
+func ListLobby(ctx *gin.Context) {
+	// Extract parameters from request.
+	miiting, _, err := extractHostParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Collect all joiners, in the order they arrived.
+	miiting.mutex.Lock()
+	entries := []*pendingParticipant{}
+	for _, entry := range miiting.pending {
+		entries = append(entries, entry)
+	}
+	miiting.mutex.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].JoinTimestamp < entries[j].JoinTimestamp
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{"participants": entries})
+}
+
+// AdmitParticipant is the handler for the host admitting a joiner waiting in
+// the lobby. The joiner takes its slot the next time it asks to join.
+func AdmitParticipant(ctx *gin.Context) {
+	setLobbyStatus(ctx, lobbyStatusAdmitted)
+}
+
+// RejectParticipant is the handler for the host rejecting a joiner waiting in
+// the lobby.
+func RejectParticipant(ctx *gin.Context) {
+	setLobbyStatus(ctx, lobbyStatusRejected)
+}
+
+// setLobbyStatus sets the status of the joiner in the lobby requested by the
+// host.
+func setLobbyStatus(ctx *gin.Context, status string) {
+	// Extract parameters from request.
+	miiting, _, err := extractHostParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Find the requested joiner in the lobby.
+	participantID := ctx.Param("participant")
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+	var entry *pendingParticipant
+	for _, pending := range miiting.pending {
+		if pending.ID == participantID {
+			entry = pending
+		}
+	}
+	if entry == nil {
+		abortWithStatusAndMessage(ctx, http.StatusNotFound,
+			"Failed to find [%s] in lobby", participantID)
+		return
+	}
+
+	// Joiners can only be admitted while there's a slot left for them.
+	slotsTaken := occupiedSlotsCount(miiting) + admittedCount(miiting)
+	if status == lobbyStatusAdmitted && entry.Status != lobbyStatusAdmitted &&
+		slotsTaken >= miiting.Capacity {
+		abortWithStatusAndMessage(ctx, http.StatusConflict,
+			"No slot left in miiting [%s]", miiting.ID)
+		return
+	}
+	entry.Status = status
+
+	ctx.JSON(http.StatusOK, entry)
+}
+
+// waitInLobby parks the joiner with the given token and participant ID in the
+// lobby of the miiting, unless the host has already admitted it. If the joiner
+// may not join yet, the request is responded with its status in the lobby and
+// the token to keep asking with. The miiting mutex must be held by the caller.
+func waitInLobby(ctx *gin.Context, miiting *miiting, token string,
+	participantID string, name string) (*pendingParticipant, bool) {
+	// Park new joiners in the lobby and let the host know about them.
+	nowNano := int64(time.Now().UnixNano())
+	entry, exists := miiting.pending[token]
+	if !exists {
+		entry = &pendingParticipant{
+			ID:            participantID,
+			Name:          name,
+			JoinTimestamp: nowNano,
+			Status:        lobbyStatusPending,
+		}
+		miiting.pending[token] = entry
+		miiting.events.publishTo(miiting.Host, "", eventTypeLobbyUpdated,
+			gin.H{"participant": entry})
+	}
+	entry.Timestamp = nowNano
+
+	// Admitted joiners go on to join the miiting, they only leave the lobby
+	// once they've taken their slot, so they may retry if joining fails.
+	switch entry.Status {
+	case lobbyStatusAdmitted:
+		return entry, true
+	case lobbyStatusRejected:
+		abortWithStatusAndMessage(ctx, http.StatusForbidden,
+			"Rejected from miiting [%s]", miiting.ID)
+		return entry, false
+	}
+
+	// Keep waiting for the host otherwise.
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"id":          miiting.ID,
+		"participant": entry,
+		"token":       token,
+	})
+	return entry, false
+}
+
+// expireLobby removes the joiners who stopped asking to join from the lobby
+// of the miiting.
+func expireLobby(miiting *miiting, nowNano int64) {
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+
+	for token, entry := range miiting.pending {
+		if nowNano-entry.Timestamp > keepAliveTimeoutNanoseconds {
+			delete(miiting.pending, token)
+		}
+	}
+}
+
+// admittedCount returns the number of joiners admitted into the miiting who
+// haven't taken their slot yet. The miiting mutex must be held by the caller.
+func admittedCount(miiting *miiting) int {
+	count := 0
+	for _, entry := range miiting.pending {
+		if entry.Status == lobbyStatusAdmitted {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"sync"
+)
+
+// Mailbox error type to signal a description is already waiting to be read.
+var errMailboxOccupied = errors.New("description already pending")
+
+// mailbox holds a single description until it is read by the receiving side
+// of a negotiation. Putting and taking never block, waiting readers are woken
+// up by the notification of updates instead.
+type mailbox struct {
+	mutex    sync.Mutex
+	content  interface{}
+	occupied bool
+	updated  chan struct{}
+}
+
+// newMailbox creates an empty mailbox.
+func newMailbox() *mailbox {
+	return &mailbox{updated: make(chan struct{})}
+}
+
+// put stores content in the mailbox. Content already waiting in the mailbox
+// is overwritten if replace is set, otherwise errMailboxOccupied is returned.
+func (mailbox *mailbox) put(content interface{}, replace bool) error {
+	mailbox.mutex.Lock()
+	defer mailbox.mutex.Unlock()
+
+	if mailbox.occupied && !replace {
+		return errMailboxOccupied
+	}
+	mailbox.content, mailbox.occupied = content, true
+	mailbox.notify()
+
+	return nil
+}
+
+// peek returns the content of the mailbox without consuming it, whether the
+// mailbox is occupied, and a channel closed on the next update of it.
+func (mailbox *mailbox) peek() (interface{}, bool, <-chan struct{}) {
+	mailbox.mutex.Lock()
+	defer mailbox.mutex.Unlock()
+
+	return mailbox.content, mailbox.occupied, mailbox.updated
+}
+
+// take consumes and returns the content of the mailbox, whether the mailbox
+// was occupied, and a channel closed on the next update of it.
+func (mailbox *mailbox) take() (interface{}, bool, <-chan struct{}) {
+	mailbox.mutex.Lock()
+	defer mailbox.mutex.Unlock()
+
+	content, occupied := mailbox.content, mailbox.occupied
+	if occupied {
+		mailbox.content, mailbox.occupied = nil, false
+		mailbox.notify()
+	}
+
+	return content, occupied, mailbox.updated
+}
+
+// notify wakes up all waiting readers. The mailbox mutex must be held by the
+// caller.
+func (mailbox *mailbox) notify() {
+	close(mailbox.updated)
+	mailbox.updated = make(chan struct{})
+}
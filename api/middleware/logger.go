@@ -24,6 +24,7 @@ var ignoredPrefixes = map[string]string{
 
 // Logger returns a request logger middleware, which logs the HTTP request and
 // creates a logger instance to be used throughout the execution of the request.
+// Credentials are redacted from the logged parameters, headers and bodies.
 func Logger() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		// Generate request ID and create new logger.
@@ -50,8 +51,8 @@ func Logger() gin.HandlerFunc {
 		// Collect relevant information from this request to be logged.
 		address := ctx.ClientIP()
 		method := ctx.Request.Method
-		params := ctx.Request.URL.RawQuery
-		headersMap, err := json.Marshal(ctx.Request.Header)
+		params := redactQuery(ctx.Request.URL.RawQuery)
+		headersMap, err := json.Marshal(redactHeaders(ctx.Request.Header))
 		if err != nil {
 			logger.Error("Failed to marshal headers: %v", err)
 			headersMap = []byte{}
@@ -74,7 +75,7 @@ func Logger() gin.HandlerFunc {
 		var body string
 		if (method == http.MethodPost || method == http.MethodPatch) &&
 			code >= http.StatusBadRequest {
-			body = string(GetBody(ctx))
+			body = string(redactBody(GetBody(ctx)))
 		}
 
 		// Log the outgoing response information.
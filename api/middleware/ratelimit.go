@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often idle clients are forgotten by rate limiters.
+const rateLimiterPruneInterval = time.Minute
+
+// RateLimiter limits the rate of requests of each client IP with a token
+// bucket. Buckets hold up to burst tokens and are refilled at the given rate,
+// each request takes a token.
+type RateLimiter struct {
+	name     string
+	rate     float64
+	burst    float64
+	mutex    sync.Mutex
+	buckets  map[string]*tokenBucket
+	pruned   time.Time
+	allowed  uint64
+	rejected uint64
+}
+
+// tokenBucket is the bucket of tokens left to a client.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiterState is the state of a rate limiter, listing the clients which
+// are being limited.
+type RateLimiterState struct {
+	Name      string          `json:"name"`
+	PerMinute int             `json:"per_minute"`
+	Burst     int             `json:"burst"`
+	Clients   int             `json:"clients"`
+	Allowed   uint64          `json:"allowed"`
+	Rejected  uint64          `json:"rejected"`
+	Limited   []LimitedClient `json:"limited"`
+}
+
+// LimitedClient is a client out of tokens, and how long it has to wait for
+// the next one.
+type LimitedClient struct {
+	Address    string  `json:"address"`
+	RetryAfter float64 `json:"retry_after"`
+}
+
+// NewRateLimiter creates a rate limiter allowing each client the given number
+// of requests per minute, in bursts of up to the given size. Rate limiters
+// allowing no requests per minute don't limit anything.
+func NewRateLimiter(name string, perMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		name:    name,
+		rate:    float64(perMinute) / time.Minute.Seconds(),
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+		pruned:  time.Now(),
+	}
+}
+
+// RateLimit returns a rate limiting middleware, which rejects the requests of
+// clients exceeding the rate of the limiter.
+func RateLimit(limiter *RateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Take a token from the bucket of the client.
+		address := ctx.ClientIP()
+		wait := limiter.take(address)
+		if wait <= 0 {
+			return
+		}
+
+		// Tell the client when to come back otherwise.
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error":      "Too many requests",
+			"request_id": GetRequestID(ctx),
+		})
+		if logger := GetLogger(ctx); logger != nil {
+			logger.Warn("Rate limited [%s] by [%s] limiter for %v",
+				address, limiter.name, wait)
+		}
+	}
+}
+
+// take takes a token from the bucket of the client, returning how long it has
+// to wait if there's none left.
+func (limiter *RateLimiter) take(address string) time.Duration {
+	if limiter.rate <= 0 {
+		return 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Refill the bucket of the client for the time since it was last updated.
+	now := time.Now()
+	limiter.prune(now)
+	bucket, exists := limiter.buckets[address]
+	if !exists {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[address] = bucket
+	}
+	limiter.refill(bucket, now)
+
+	// Take a token if there's one left.
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		limiter.allowed++
+		return 0
+	}
+	limiter.rejected++
+
+	return limiter.timeUntilToken(bucket)
+}
+
+// State returns the current state of the rate limiter.
+func (limiter *RateLimiter) State() RateLimiterState {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Collect the clients out of tokens, those who wait the longest first.
+	now := time.Now()
+	state := RateLimiterState{
+		Name:      limiter.name,
+		PerMinute: int(limiter.rate*time.Minute.Seconds() + 0.5),
+		Burst:     int(limiter.burst),
+		Clients:   len(limiter.buckets),
+		Allowed:   limiter.allowed,
+		Rejected:  limiter.rejected,
+		Limited:   []LimitedClient{},
+	}
+	for address, bucket := range limiter.buckets {
+		limiter.refill(bucket, now)
+		if bucket.tokens < 1 {
+			state.Limited = append(state.Limited, LimitedClient{
+				Address:    address,
+				RetryAfter: limiter.timeUntilToken(bucket).Seconds(),
+			})
+		}
+	}
+	sort.Slice(state.Limited, func(i, j int) bool {
+		return state.Limited[i].RetryAfter > state.Limited[j].RetryAfter
+	})
+
+	return state
+}
+
+// refill adds the tokens the bucket has earned since it was last updated. The
+// limiter mutex must be held by the caller.
+func (limiter *RateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+elapsed*limiter.rate)
+	bucket.updated = now
+}
+
+// timeUntilToken returns how long until the bucket holds a token again. The
+// limiter mutex must be held by the caller.
+func (limiter *RateLimiter) timeUntilToken(bucket *tokenBucket) time.Duration {
+	seconds := (1 - bucket.tokens) / limiter.rate
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// prune forgets the clients whose buckets have been refilled, since they're
+// no different from new clients. The limiter mutex must be held by the caller.
+func (limiter *RateLimiter) prune(now time.Time) {
+	if now.Sub(limiter.pruned) < rateLimiterPruneInterval {
+		return
+	}
+
+	limiter.pruned = now
+	for address, bucket := range limiter.buckets {
+		limiter.refill(bucket, now)
+		if bucket.tokens >= limiter.burst {
+			delete(limiter.buckets, address)
+		}
+	}
+}
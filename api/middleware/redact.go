@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces sensitive values in logs.
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders is a list of request headers carrying credentials.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":          true,
+	"Proxy-Authorization":    true,
+	"Cookie":                 true,
+	"Sec-Websocket-Protocol": true,
+	"X-Api-Key":              true,
+}
+
+// sensitiveKeys matches the names of query parameters and JSON fields
+// carrying credentials, e.g. token, resume_token or passcode.
+var sensitiveKeys = regexp.MustCompile(`(?i)token|passcode|secret`)
+
+// sensitiveFields matches JSON string fields carrying credentials.
+var sensitiveFields = regexp.MustCompile(
+	`(?i)("[^"]*(?:token|passcode|secret)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// redactQuery returns the raw query with the values of sensitive parameters
+// redacted, keeping the order of the parameters.
+func redactQuery(query string) string {
+	if len(query) <= 0 {
+		return query
+	}
+
+	params := strings.Split(query, "&")
+	for idx, param := range params {
+		key := strings.SplitN(param, "=", 2)[0]
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if sensitiveKeys.MatchString(name) {
+			params[idx] = key + "=" + redacted
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// redactHeaders returns a copy of the headers with the values of sensitive
+// headers redacted.
+func redactHeaders(headers http.Header) http.Header {
+	copied := http.Header{}
+	for name, values := range headers {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			values = []string{redacted}
+		}
+		copied[name] = values
+	}
+
+	return copied
+}
+
+// redactBody returns the copied request body with the values of sensitive
+// JSON fields redacted. The copy may be truncated, so it isn't parsed.
+func redactBody(body []byte) []byte {
+	body = bytes.TrimRight(body, "\x00")
+	return sensitiveFields.ReplaceAll(body, []byte(`$1"`+redacted+`"`))
+}
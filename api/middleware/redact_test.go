@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestRedactQuery checks the values of sensitive query parameters are
+// redacted, and the others kept as they were.
+func TestRedactQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		redacted string
+	}{
+		{"", ""},
+		{"round=2&peek=true", "round=2&peek=true"},
+		{"token=abc", "token=" + redacted},
+		{"round=2&resume_token=abc&peek", "round=2&resume_token=" + redacted +
+			"&peek"},
+		{"Passcode=1234&name=x", "Passcode=" + redacted + "&name=x"},
+		{"client_secret=a=b", "client_secret=" + redacted},
+		{"%74oken=abc", "%74oken=" + redacted},
+		{"token", "token=" + redacted},
+		{"%zztoken=abc", "%zztoken=" + redacted},
+	}
+
+	for _, test := range tests {
+		if redactedQuery := redactQuery(test.query); redactedQuery !=
+			test.redacted {
+			t.Errorf("redactQuery(%q) = %q, want %q", test.query,
+				redactedQuery, test.redacted)
+		}
+	}
+}
+
+// TestRedactHeaders checks the values of sensitive headers are redacted in
+// a copy of the headers.
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{
+		"Authorization":          {"Bearer abc"},
+		"Cookie":                 {"session=abc"},
+		"Sec-Websocket-Protocol": {"bearer, abc"},
+		"X-Api-Key":              {"abc"},
+		"x-api-key":              {"abc"},
+		"Content-Type":           {"application/json"},
+		"User-Agent":             {"test"},
+	}
+	expected := http.Header{
+		"Authorization":          {redacted},
+		"Cookie":                 {redacted},
+		"Sec-Websocket-Protocol": {redacted},
+		"X-Api-Key":              {redacted},
+		"x-api-key":              {redacted},
+		"Content-Type":           {"application/json"},
+		"User-Agent":             {"test"},
+	}
+
+	if redactedHeaders := redactHeaders(headers); !reflect.DeepEqual(
+		redactedHeaders, expected) {
+		t.Errorf("redactHeaders() = %v, want %v", redactedHeaders, expected)
+	}
+	if headers.Get("Authorization") != "Bearer abc" {
+		t.Errorf("redactHeaders() modified the original headers")
+	}
+}
+
+// TestRedactBody checks the values of sensitive JSON fields are redacted,
+// even in truncated bodies.
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		redacted string
+	}{
+		{`{"id":"m","name":"x"}`, `{"id":"m","name":"x"}`},
+		{`{"m":{"token":"abc","name":"x"}}`,
+			`{"m":{"token":"` + redacted + `","name":"x"}}`},
+		{`{"m": {"resume_token" : "abc", "passcode":"1234"}}`,
+			`{"m": {"resume_token" : "` + redacted + `", "passcode":"` +
+				redacted + `"}}`},
+		{`{"secret":"a\"b"}`, `{"secret":"` + redacted + `"}`},
+		{`{"token":"abc`, `{"token":"` + redacted + `"`},
+		{"{\"token\":\"abc\"}\x00\x00", `{"token":"` + redacted + `"}`},
+		{`{"capacity":4,"token":null}`, `{"capacity":4,"token":null}`},
+	}
+
+	for _, test := range tests {
+		if body := string(redactBody([]byte(test.body))); body !=
+			test.redacted {
+			t.Errorf("redactBody(%q) = %q, want %q", test.body, body,
+				test.redacted)
+		}
+	}
+}
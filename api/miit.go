@@ -2,12 +2,16 @@ package api
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
-	"strings"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -48,25 +52,71 @@ func (syncmap *syncmap) MarshalJSON() ([]byte, error) {
 
 // miiting is the object representing a miiting.
 type miiting struct {
+	ID           string                         `json:"id"`
+	Title        string                         `json:"title,omitempty"`
+	Timestamp    int64                          `json:"timestamp"`
+	Created      int64                          `json:"created"`
+	Capacity     int                            `json:"capacity"`
+	Deadline     int64                          `json:"deadline,omitempty"`
+	Lobby        bool                           `json:"lobby"`
+	RelayOnly    bool                           `json:"relay_only"`
+	Host         string                         `json:"host"`
+	Locked       bool                           `json:"locked"`
+	Tokens       syncmap                        `json:"-"`
+	ctx          context.Context                `json:"-"`
+	cancel       context.CancelFunc             `json:"-"`
+	mutex        sync.Mutex                     `json:"-"`
+	passcodeSalt []byte                         `json:"-"`
+	passcodeHash []byte                         `json:"-"`
+	links        map[string]*link               `json:"-"`
+	departed     map[string]*participant        `json:"-"`
+	pending      map[string]*pendingParticipant `json:"-"`
+	revoked      syncmap                        `json:"-"`
+	kicked       syncmap                        `json:"-"`
+	linksUpdated chan struct{}                  `json:"-"`
+	deleteChan   chan bool                      `json:"-"`
+	events       *eventHub                      `json:"-"`
+}
+
+// participant is the object representing a participant of a miiting. Peers
+// address each other by participant ID, tokens are never revealed to them.
+type participant struct {
 	ID            string             `json:"id"`
+	Name          string             `json:"name,omitempty"`
+	Role          string             `json:"role"`
+	JoinTimestamp int64              `json:"join_timestamp"`
 	Timestamp     int64              `json:"timestamp"`
-	Tokens        syncmap            `json:"tokens"`
+	resumeToken   string             `json:"-"`
+	clientIP      string             `json:"-"`
 	ctx           context.Context    `json:"-"`
 	cancel        context.CancelFunc `json:"-"`
-	offerSdpChan  chan interface{}   `json:"-"`
-	offerIceChan  chan interface{}   `json:"-"`
-	answerSdpChan chan interface{}   `json:"-"`
-	answerIceChan chan interface{}   `json:"-"`
-	deleteChan    chan bool          `json:"-"`
 }
 
-// miitings contains all current miitings.
-var miitings syncmap
+// Reasons for participants leaving a miiting.
+const (
+	leaveReasonLeft     = "left"
+	leaveReasonTimedOut = "timed_out"
+	leaveReasonKicked   = "kicked"
+)
+
+// Roles assigned to participants when they join a miiting. Whoever is alone
+// in the miiting offers to the peers joining later, who answer. Participants
+// rejoining take their place behind those who stayed, and answer them.
+const (
+	roleOfferer  = "offerer"
+	roleAnswerer = "answerer"
+)
+
+// store holds all current miitings.
+var store MiitingStore
 
 //go:generate go-assets-builder -p assets -o ../assets/assets.go ../assets
 // miitAssetsServer handles the embedded assets from our in-memory filesystem.
 var miitAssetServer = http.FileServer(assets.Assets)
 
+// The longest extension of a miiting with no maximum duration configured.
+const maxExtension = 24 * time.Hour
+
 // Parameter error type to signal parameter extraction failed.
 var errParameterExtractionFailed = errors.New("parameter extraction failed")
 
@@ -75,6 +125,16 @@ var sdpWaitTimeout time.Duration
 var keepAliveInterval time.Duration
 var keepAliveTimeout time.Duration
 var keepAliveTimeoutNanoseconds int64
+var defaultCapacity int
+var maxCapacity int
+var resumeGracePeriod time.Duration
+var snapshotPath string
+var maxDuration time.Duration
+var maxExtendedDuration time.Duration
+var durationWarning time.Duration
+var passcodeThrottle *failureThrottle
+var maxIceCandidates int
+var maxNegotiationRounds int64
 
 func init() {
 	// Load configuration values.
@@ -82,24 +142,63 @@ func init() {
 	keepAliveInterval = config.GetMilliseconds("MIIT_KEEPALIVE_INTERVAL")
 	keepAliveTimeout = config.GetMilliseconds("MIIT_KEEPALIVE_TIMEOUT")
 	keepAliveTimeoutNanoseconds = keepAliveTimeout.Nanoseconds()
+	defaultCapacity = config.GetInt("MIIT_DEFAULT_CAPACITY")
+	maxCapacity = config.GetInt("MIIT_MAX_CAPACITY")
+	resumeGracePeriod = config.GetMilliseconds("MIIT_RESUME_GRACE_PERIOD")
+	snapshotPath = config.GetString("MIIT_SNAPSHOT_PATH")
+	maxDuration = config.GetMilliseconds("MIIT_MAX_DURATION")
+	maxExtendedDuration = config.GetMilliseconds("MIIT_MAX_EXTENDED_DURATION")
+	durationWarning = config.GetMilliseconds("MIIT_DURATION_WARNING")
+	passcodeThrottle = newFailureThrottle(
+		config.GetInt("MIIT_PASSCODE_MAX_FAILURES"),
+		config.GetMilliseconds("MIIT_PASSCODE_FAILURE_WINDOW"))
+	maxIceCandidates = config.GetInt("MIIT_MAX_ICE_CANDIDATES")
+	maxNegotiationRounds = config.GetInt64("MIIT_MAX_NEGOTIATION_ROUNDS")
+
+	// Open the miiting store, restore the snapshot we may have left behind
+	// and resume monitoring the miitings.
+	var err error
+	store, err = openMiitingStore(config.GetString("MIIT_STORE"),
+		config.GetString("MIIT_STORE_PATH"))
+	if err != nil {
+		panic(err)
+	}
+	if err := restoreSnapshot(); err != nil {
+		panic(err)
+	}
+	for _, miiting := range store.List() {
+		go miitingMonitor(miiting)
+	}
 
 	// Setup handlers for assets and random miiting requests.
 	GetRoot().GET("/random", RedirectToRandomMiiting)
 	GetRoot().GET("/assets/:asset", GetMiitAsset)
 
 	// Setup handlers for admin module.
-	adminGroup := GetRoot().Group("admin")
-	adminGroup.GET("miitings", ListMiitings)
+	adminGroup := getAdminGroup()
+	adminGroup.GET("miitings", authorizeAdmin(adminScopeReadOnly),
+		ListMiitings)
+	adminGroup.POST("miitings/:miiting/extend",
+		authorizeAdmin(adminScopeOperator), ExtendMiiting)
 
 	// Setup miiting module and register handlers.
 	// TODO: use PushMiitAssets when HTTP/2 server push is ready.
-	miitingsGroup := GetRoot().Group("miitings")
-	miitingsGroup.POST("", CreateAndJoinMiiting)
+	creationGroup("miitings").POST("", CreateAndJoinMiiting)
+	miitingsGroup := signalingGroup("miitings")
 	miitingsGroup.GET(":miiting", GetMiiting)
 	miitingsGroup.PATCH(":miiting", KeepAlive)
 	miitingsGroup.DELETE(":miiting", DeleteMiiting)
+	miitingsGroup.DELETE(":miiting/participant", LeaveMiiting)
 	miitingsGroup.POST(":miiting", SendDescription)
-	miitingsGroup.GET(":miiting/:sdp_type", ReceiveDescription)
+	miitingsGroup.GET(":miiting/:sdp_type", routeByParam("sdp_type",
+		map[string]gin.HandlerFunc{
+			"ws":          ConnectWebSocket,
+			"events":      StreamEvents,
+			"lobby":       ListLobby,
+			"ice_servers": GetIceServers,
+			"config":      GetClientConfig,
+		},
+		ReceiveDescription))
 	miitingsGroup.POST(":miiting/:sdp_type", SendIceCandidates)
 	miitingsGroup.GET(":miiting/:sdp_type/ice_candidates",
 		ReceiveIceCandidates)
@@ -113,28 +212,26 @@ func RedirectToRandomMiiting(ctx *gin.Context) {
 	// Iterate through the current miitings and randomly choose one to redirect to.
 	var chosen string
 	count := 1
-	miitings.Range(func(key, value interface{}) bool {
-		// Obtain the original key/value.
-		miitingID := key.(string)
-		miiting := value.(*miiting)
-
-		// Make sure the meeting is not established and ongoing.
+	for _, miiting := range store.List() {
+		// Make sure the meeting is not established and ongoing, nor protected.
 		// "cafeteria" is reserved for Zhe & Mao.
-		if mapEntriesCount(&(miiting.Tokens)) >= 2 ||
-			miitingID == "cafeteria" {
-			return true
+		miiting.mutex.Lock()
+		full := occupiedSlotsCount(miiting) >= miiting.Capacity
+		miiting.mutex.Unlock()
+		if full || isProtected(miiting) ||
+			miiting.ID == "cafeteria" {
+			continue
 		}
 
 		// Roll the dice, see if we should pick this one.
 		if rand.Int()%count == 0 {
-			chosen = miitingID
-			return false
+			chosen = miiting.ID
+			break
 		}
 
 		// None is chosen, continue onto the next miiting.
 		count++
-		return true
-	})
+	}
 
 	// Set no-cache response headers first.
 	ctx.Request.Header.Add("Cache-Control", "no-cache")
@@ -167,16 +264,73 @@ func GetMiitAsset(ctx *gin.Context) {
 
 // ListMiitings returns a list of all current existing miitings.
 func ListMiitings(ctx *gin.Context) {
-	// Only requests originating from loopback interface are accepted.
-	if !strings.HasPrefix(ctx.Request.Host, "localhost") &&
-		!strings.HasPrefix(ctx.Request.Host, "127.0.0.1") {
-		abortWithStatusAndMessage(ctx, http.StatusForbidden,
-			"Access to admin API is forbidden")
+	// Return the marshalled JSON list of all current miitings, listing their
+	// participants without the tokens they were issued.
+	entries := []map[string]interface{}{}
+	for _, stored := range store.List() {
+		entries = append(entries, map[string]interface{}{
+			stored.ID: struct {
+				*miiting
+				Participants []*participant `json:"participants"`
+			}{stored, getPeers(stored, "")},
+		})
+	}
+	ctx.JSON(http.StatusOK, entries)
+}
+
+// ExtendMiiting extends the maximum duration of a miiting by the requested
+// number of milliseconds, at most by the maximum duration of miitings. No
+// miiting may be extended past the maximum extended duration since creation.
+func ExtendMiiting(ctx *gin.Context) {
+	// Get the extension from request body.
+	body := struct {
+		Extension int64 `json:"extension"`
+	}{}
+	limit := maxDuration
+	if limit <= 0 {
+		limit = maxExtension
+	}
+	err := ctx.BindJSON(&body)
+	if err != nil || body.Extension <= 0 ||
+		body.Extension > int64(limit/time.Millisecond) {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid miiting extension: [%d]", body.Extension)
+		return
+	}
+
+	// Push the deadline of the miiting back, if it has one.
+	miitingID := ctx.Param("miiting")
+	miiting, exists := store.Load(miitingID)
+	if !exists {
+		abortWithStatusAndMessage(ctx, http.StatusNotFound,
+			"Failed to find miiting [%s]", miitingID)
 		return
 	}
+	extension := body.Extension * int64(time.Millisecond)
+	latest := miiting.Created + maxExtendedDuration.Nanoseconds()
+	deadline := atomic.LoadInt64(&(miiting.Deadline))
+	for deadline > 0 && deadline+extension <= latest &&
+		!atomic.CompareAndSwapInt64(&(miiting.Deadline), deadline,
+			deadline+extension) {
+		deadline = atomic.LoadInt64(&(miiting.Deadline))
+	}
+	if deadline <= 0 {
+		abortWithStatusAndMessage(ctx, http.StatusConflict,
+			"Miiting [%s] has no maximum duration", miitingID)
+		return
+	} else if deadline+extension > latest {
+		abortWithStatusAndMessage(ctx, http.StatusConflict,
+			"Miiting [%s] can't be extended past %s", miitingID,
+			time.Unix(0, latest).UTC().Format(time.RFC3339))
+		return
+	}
+	updateMiiting(miiting)
 
-	// Return the marshalled JSON list of all current miitings.
-	ctx.JSON(http.StatusOK, &miitings)
+	// Let the participants know they've got more time.
+	deadline += extension
+	miiting.events.publish("", eventTypeMiitingExtended,
+		gin.H{"deadline": deadline})
+	ctx.JSON(http.StatusOK, gin.H{"id": miiting.ID, "deadline": deadline})
 }
 
 // PushMiitAssets is the handler for pushing the miit assets to clients.
@@ -215,10 +369,22 @@ func PushMiitAssets(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{})
 }
 
-// CreateAndJoinMiiting is the handler for requests creating a miiting.
+// CreateAndJoinMiiting is the handler for requests creating or joining a
+// miiting. The response carries the participant record and token issued to
+// the client, the peers it should connect to, and a resume token to reclaim
+// its slot after losing its connection.
 func CreateAndJoinMiiting(ctx *gin.Context) {
-	// Get miiting initiator name from request body.
-	body := map[string]map[string]string{}
+	// Get miiting ID and participant token from request body.
+	body := map[string]struct {
+		Token       string `json:"token"`
+		ResumeToken string `json:"resume_token"`
+		Name        string `json:"name"`
+		Passcode    string `json:"passcode"`
+		Capacity    int    `json:"capacity"`
+		Lobby       bool   `json:"lobby"`
+		RelayOnly   bool   `json:"relay_only"`
+		MaxDuration int64  `json:"max_duration"`
+	}{}
 	if err := ctx.BindJSON(&body); err != nil {
 		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
 			"Failed to unmarshal miiting creation request: %v", err)
@@ -226,46 +392,240 @@ func CreateAndJoinMiiting(ctx *gin.Context) {
 	}
 
 	// Get miiting ID, there should be only one key, so we pick the first.
-	var miitingID, token string
+	var miitingID, token, resumeToken, name, passcode string
+	var capacity int
+	var lobby, relayOnly bool
+	var duration time.Duration
 	for key, val := range body {
 		miitingID = key
-		token = val["token"]
+		token = val.Token
+		resumeToken = val.ResumeToken
+		name = val.Name
+		passcode = val.Passcode
+		capacity = val.Capacity
+		lobby = val.Lobby
+		relayOnly = val.RelayOnly
+		duration = time.Duration(val.MaxDuration) * time.Millisecond
 		break
 	}
 
-	// Check and create the miiting if it doesn't exist.
-	value := miiting{}
-	miitingIntf, exists := miitings.LoadOrStore(miitingID, &value)
-	storedMiiting, _ := miitingIntf.(*miiting)
+	// Verify the token we were issued, if any, before anything else. Our
+	// participant ID is the one bound to it, or a new one otherwise.
+	if len(token) <= 0 {
+		token = extractToken(ctx)
+	}
+	participantID := generateID()
+	if len(token) > 0 {
+		claims, err := verifyToken(token, miitingID)
+		if err != nil {
+			abortWithStatusAndMessage(ctx, http.StatusUnauthorized,
+				"Unauthorized token: %v", err)
+			return
+		}
+		participantID = claims.ParticipantID
+	} else {
+		token = mintToken(miitingID, participantID, time.Now().Add(tokenTTL))
+	}
+
+	// Use the default capacity unless another one is requested.
+	capacity, valid := resolveCapacity(ctx, capacity)
+	if !valid {
+		return
+	}
+
+	// Miitings last for the maximum duration unless a shorter one is
+	// requested.
+	if duration < 0 || (maxDuration > 0 && duration > maxDuration) {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid miiting duration: [%v]", duration)
+		return
+	} else if duration == 0 {
+		duration = maxDuration
+	}
+
+	// Scheduled miitings can only be joined within their window.
+	schedule, scheduled := loadSchedule(miitingID)
+	if scheduled && !checkSchedule(ctx, schedule) {
+		return
+	}
+
+	// Check and create the miiting if it doesn't exist, with the settings it
+	// was scheduled with if any.
 	nowNano := int64(time.Now().UnixNano())
-	if !exists {
-		storedMiiting.ID = miitingID
-		atomic.StoreInt64(&(storedMiiting.Timestamp), nowNano)
-		storedMiiting.Tokens = syncmap{}
-		storedMiiting.Tokens.Store(token, nowNano)
-		storedMiiting.offerSdpChan = make(chan interface{}, 1)
-		storedMiiting.offerIceChan = make(chan interface{}, 1)
-		storedMiiting.answerSdpChan = make(chan interface{}, 1)
-		storedMiiting.answerIceChan = make(chan interface{}, 1)
-		storedMiiting.deleteChan = make(chan bool, 2)
-		storedMiiting.ctx, storedMiiting.cancel =
-			context.WithCancel(global.Context)
+	value := newMiiting(miitingID, capacity, nowNano)
+	value.Lobby, value.Host = lobby, participantID
+	value.RelayOnly = relayOnly
+	setPasscode(value, passcode)
+	if duration > 0 {
+		value.Deadline = nowNano + duration.Nanoseconds()
+	}
+	if scheduled {
+		applySchedule(value, schedule)
+	}
+	storedMiiting, exists, err := store.Create(value)
+	if err != nil {
+		value.cancel()
+		abortWithStatusAndMessage(ctx, http.StatusInternalServerError,
+			"Failed to create miiting [%s]: %v", miitingID, err)
+		return
+	} else if exists {
+		value.cancel()
+	} else {
 		go miitingMonitor(storedMiiting)
-		ctx.JSON(http.StatusCreated, storedMiiting)
+	}
+
+	// The creator hosts the miiting, unless it was scheduled by someone else.
+	creator := !exists
+	if scheduled {
+		creator = participantID == storedMiiting.Host
+	}
+
+	// Verify the passcode before taking the miiting mutex, as hashing it is
+	// slow on purpose. It's only enforced on joiners who turn out to be new.
+	passcodeValid, passcodeWait := true, time.Duration(0)
+	if !creator {
+		passcodeValid, passcodeWait = verifyPasscode(ctx, storedMiiting,
+			passcode)
+	}
+
+	// Join the miiting, unless it's already full. Resuming participants
+	// reclaim the slot they already occupy.
+	storedMiiting.mutex.Lock()
+	if _, revoked := storedMiiting.revoked.Load(token); revoked {
+		storedMiiting.mutex.Unlock()
+		abortWithStatusAndMessage(ctx, http.StatusForbidden,
+			"Revoked token for miiting [%s]", miitingID)
+		return
+	}
+	rejoined := getParticipant(storedMiiting, token)
+	var resumed *participant
+	if rejoined == nil && len(resumeToken) > 0 {
+		resumed = resumeParticipant(storedMiiting, resumeToken)
+	}
+	if rejoined == nil && resumed == nil &&
+		participantIsPresent(storedMiiting, participantID) {
+		storedMiiting.mutex.Unlock()
+		abortWithStatusAndMessage(ctx, http.StatusConflict,
+			"Participant [%s] is already in miiting [%s]", participantID,
+			miitingID)
+		return
+	}
+	if !creator && rejoined == nil && resumed == nil &&
+		!checkPasscode(ctx, storedMiiting, passcodeValid, passcodeWait) {
+		storedMiiting.mutex.Unlock()
 		return
 	}
 
-	// At most two users are allowed to join a miiting.
-	if mapEntriesCount(&storedMiiting.Tokens) < 2 {
-		// Add to the list of participating user tokens. if
-		storedMiiting.Tokens.Store(token, nowNano)
-		ctx.JSON(http.StatusOK, storedMiiting)
+	// Nobody new may join a locked miiting.
+	if storedMiiting.Locked && rejoined == nil && resumed == nil {
+		storedMiiting.mutex.Unlock()
+		abortWithStatusAndMessage(ctx, http.StatusLocked,
+			"Miiting [%s] is locked", miitingID)
 		return
 	}
 
-	// Two clients have already joined, reject the request.
-	abortWithStatusAndMessage(ctx, http.StatusTooManyRequests,
-		"Cannot join ongoing miiting [%s]", miitingID)
+	// Wait in the lobby until the host admits us. Joiners without a token get
+	// a new identity, so those from the address of a kicked participant have
+	// to wait there too, even if the miiting has no lobby.
+	var admitted *pendingParticipant
+	_, kicked := storedMiiting.kicked.Load(ctx.ClientIP())
+	if (storedMiiting.Lobby || kicked) && !creator && rejoined == nil &&
+		resumed == nil {
+		entry, mayJoin := waitInLobby(ctx, storedMiiting, token,
+			participantID, name)
+		if !mayJoin {
+			storedMiiting.mutex.Unlock()
+			return
+		}
+		admitted = entry
+	}
+	if rejoined == nil && resumed == nil &&
+		occupiedSlotsCount(storedMiiting) >= storedMiiting.Capacity {
+		storedMiiting.mutex.Unlock()
+		abortWithStatusAndMessage(ctx, http.StatusTooManyRequests,
+			"Cannot join ongoing miiting [%s]", miitingID)
+		return
+	}
+
+	// Assign our role, rejoining participants keep their connections,
+	// resuming participants keep their ID and role, for which they're issued
+	// a new token.
+	participant := newParticipant(storedMiiting, nowNano)
+	participant.ID, participant.Name = participantID, name
+	participant.clientIP = ctx.ClientIP()
+	if admitted != nil && len(participant.Name) <= 0 {
+		participant.Name = admitted.Name
+	}
+	if rejoined != nil {
+		participant.cancel()
+		participant.ctx, participant.cancel = rejoined.ctx, rejoined.cancel
+		if len(participant.Name) <= 0 {
+			participant.Name = rejoined.Name
+		}
+	}
+	participant.Role = roleAnswerer
+	if len(getPeers(storedMiiting, participant.ID)) <= 0 {
+		participant.Role = roleOfferer
+	}
+	if resumed != nil && resumed.ID != participantID {
+		token = mintToken(miitingID, resumed.ID, time.Now().Add(tokenTTL))
+	}
+	if resumed != nil {
+		participant.ID = resumed.ID
+		participant.Role = resumed.Role
+		participant.JoinTimestamp = resumed.JoinTimestamp
+		if len(participant.Name) <= 0 {
+			participant.Name = resumed.Name
+		}
+	}
+	if err := store.Join(storedMiiting, token, participant); err != nil {
+		storedMiiting.mutex.Unlock()
+		abortWithStatusAndMessage(ctx, http.StatusInternalServerError,
+			"Failed to join miiting [%s]: %v", miitingID, err)
+		return
+	}
+	if admitted != nil {
+		delete(storedMiiting.pending, token)
+	}
+	storedMiiting.mutex.Unlock()
+
+	// Hand the offer to our peers if we rejoined, or restart the negotiations
+	// in our old role if we resumed. Then take over any links waiting for us,
+	// and let our peers know we're here.
+	if rejoined != nil {
+		restartLinks(storedMiiting, participant, false)
+	} else if resumed != nil {
+		restartLinks(storedMiiting, participant,
+			participant.Role == roleOfferer)
+	}
+	bindPendingLinks(storedMiiting, participant)
+	storedMiiting.events.publish(participant.ID, eventTypePeerJoined,
+		gin.H{
+			"peer":     participant,
+			"rejoined": rejoined != nil,
+			"resumed":  resumed != nil,
+		})
+
+	// Respond with our participant record and the peers to connect to.
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	ctx.JSON(status, gin.H{
+		"id":           storedMiiting.ID,
+		"title":        storedMiiting.Title,
+		"timestamp":    atomic.LoadInt64(&(storedMiiting.Timestamp)),
+		"capacity":     storedMiiting.Capacity,
+		"deadline":     atomic.LoadInt64(&(storedMiiting.Deadline)),
+		"lobby":        storedMiiting.Lobby,
+		"relay_only":   isRelayOnly(storedMiiting),
+		"host":         storedMiiting.Host,
+		"locked":       storedMiiting.Locked,
+		"participant":  participant,
+		"token":        token,
+		"resume_token": participant.resumeToken,
+		"peers":        getPeers(storedMiiting, participant.ID),
+	})
 }
 
 // KeepAlive is the handler for keep-alive requests.
@@ -277,70 +637,125 @@ func KeepAlive(ctx *gin.Context) {
 	}
 
 	// Update timestamps.
-	nowNano := int64(time.Now().UnixNano())
-	atomic.StoreInt64(&(miiting.Timestamp), nowNano)
-	miiting.Tokens.Store(token, nowNano)
+	refreshTimestamps(miiting, token)
 
 	// Done refreshing timestamps, return empty response.
 	ctx.JSON(http.StatusOK, gin.H{})
 }
 
-// DeleteMiiting is the handler for requests deleting a miiting.
+// DeleteMiiting is the handler for requests deleting a miiting. Only the host
+// may end the miiting for everyone, other participants have to leave it.
 func DeleteMiiting(ctx *gin.Context) {
+	// Extract parameters from request, only the host may proceed.
+	miiting, _, err := extractHostParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Notify monitor to delete miiting, unless it already has been.
+	select {
+	case miiting.deleteChan <- true:
+	default:
+	}
+	ctx.JSON(http.StatusOK, gin.H{})
+}
+
+// LeaveMiiting is the handler for requests leaving a miiting. The miiting
+// goes on for the remaining participants, and ends once everyone has left.
+func LeaveMiiting(ctx *gin.Context) {
 	// Extract parameters from request.
-	miiting, _, _, err := extractParameters(ctx, false)
+	miiting, _, token, err := extractParameters(ctx, false)
 	if err != nil {
 		return
 	}
 
-	// Notify monitor to delete miiting.
-	miiting.deleteChan <- true
+	// Remove ourselves from the miiting.
+	removeParticipant(miiting, token, leaveReasonLeft)
 	ctx.JSON(http.StatusOK, gin.H{})
 }
 
-// ReceiveDescription is the handler for receiving a SDP offer / answer.
+// ReceiveDescription is the handler for receiving a SDP offer / answer. The
+// optional round selects the negotiation round, defaulting to the current.
+// Receiving consumes the SDP unless peek is set.
 func ReceiveDescription(ctx *gin.Context) {
 	// Extract parameters from request.
-	miiting, sdpType, _, err := extractParameters(ctx, true)
+	miiting, sdpType, token, err := extractParameters(ctx, true)
+	if err != nil {
+		return
+	}
+	participant := getParticipant(miiting, token)
+	link, err := getPeerLink(ctx, miiting, participant)
+	if err != nil {
+		return
+	}
+	round, err := getRound(ctx)
 	if err != nil {
 		return
 	}
 
-	// Get the channel cooresponding to our type from our miiting.
-	var sdpChan chan interface{}
-	if sdpType == "offer" {
-		sdpChan = miiting.offerSdpChan
-	} else if sdpType == "answer" {
-		sdpChan = miiting.answerSdpChan
-	} else {
+	// Validate the requested SDP type.
+	if sdpType != "offer" && sdpType != "answer" {
 		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
 			"Invalid SDP type: [%s]", sdpType)
 		return
 	}
 
+	// Peeking leaves the SDP in the mailbox for later requests to receive.
+	peek := ctx.Query("peek") == "true"
+
 	// Read & wait for the SDP to be submitted by the other client.
-	var sdp interface{}
-	select {
-	case sdp = <-sdpChan:
-	case <-time.After(sdpWaitTimeout):
-	case <-miiting.ctx.Done():
-	}
+	waitCtx, cancel := context.WithTimeout(participant.ctx, sdpWaitTimeout)
+	defer cancel()
+	for {
+		// Get the negotiation round we're waiting on.
+		negotiation, err := awaitNegotiation(waitCtx, link, round)
+		if err != nil {
+			abortWithNegotiationError(ctx, err)
+			return
+		}
 
-	// Respond with error code if waiting for the description has timed out.
-	if sdp == nil {
-		abortWithStatusAndMessage(ctx, http.StatusGatewayTimeout,
-			"No description received from peer")
-		return
-	}
+		// Respond with the SDP if it has already been submitted.
+		mailbox := negotiation.mailbox(sdpType)
+		read := mailbox.take
+		if peek {
+			read = mailbox.peek
+		}
+		sdp, occupied, updated := read()
+		if occupied {
+			ctx.Header("X-Negotiation-Round",
+				strconv.FormatInt(negotiation.Round, 10))
+			ctx.JSON(http.StatusOK, sdp)
+			return
+		}
 
-	// Respond with the received SDP.
-	ctx.JSON(http.StatusOK, sdp)
+		// Wait until the SDP arrives, or the round gets superseded.
+		select {
+		case <-updated:
+		case <-negotiation.superseded:
+		case <-waitCtx.Done():
+			// Respond with error code if waiting for SDP has timed out.
+			abortWithStatusAndMessage(ctx, http.StatusGatewayTimeout,
+				"No description received from peer")
+			return
+		}
+	}
 }
 
-// SendDescription is the handler for sending a SDP offer / answer.
+// SendDescription is the handler for sending a SDP offer / answer. Sending an
+// offer for the round after the current one starts a new negotiation round.
+// A SDP the peer hasn't received yet is rejected unless replace is set.
 func SendDescription(ctx *gin.Context) {
 	// Extract parameters from request.
-	miiting, _, _, err := extractParameters(ctx, false)
+	miiting, _, token, err := extractParameters(ctx, false)
+	if err != nil {
+		return
+	}
+	participant := getParticipant(miiting, token)
+	link, err := getPeerLink(ctx, miiting, participant)
+	if err != nil {
+		return
+	}
+	round, err := getRound(ctx)
 	if err != nil {
 		return
 	}
@@ -358,74 +773,136 @@ func SendDescription(ctx *gin.Context) {
 		return
 	}
 
-	// Get the requested SDP from our miiting.
-	if sdpEntity.Offer != nil && miiting.offerSdpChan != nil {
-		// Send the submitted offer over the offer channel.
-		miiting.offerSdpChan <- sdpEntity.Offer
-	} else if sdpEntity.Answer != nil && miiting.answerSdpChan != nil {
-		// Send the submitted answer over the answer channel.
-		miiting.answerSdpChan <- sdpEntity.Answer
+	// Get the submitted SDP and its type.
+	var sdpType string
+	var sdp interface{}
+	if sdpEntity.Offer != nil {
+		sdpType, sdp = "offer", sdpEntity.Offer
+	} else if sdpEntity.Answer != nil {
+		sdpType, sdp = "answer", sdpEntity.Answer
 	} else {
 		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
 			"Failed to unmarshal offer / answer from request")
 		return
 	}
 
-	// Respond with empty JSON.
-	ctx.JSON(http.StatusOK, gin.H{})
+	// Submit the SDP to the requested negotiation round.
+	replace := ctx.Query("replace") == "true"
+	negotiation, err := submitDescription(miiting, link, round,
+		participant.ID, sdpType, sdp, replace)
+	if err != nil {
+		abortWithNegotiationError(ctx, err)
+		return
+	}
+
+	// Respond with the negotiation round of our SDP.
+	ctx.JSON(http.StatusOK, gin.H{"round": negotiation.Round})
 }
 
-// ReceiveIceCandidates is the handler for receiving ICE candidates.
+// ReceiveIceCandidates is the handler for receiving ICE candidates. Without
+// a cursor, it responds with a plain list of the candidates received so far.
+// With a cursor, it responds with the candidates after the cursor, the cursor
+// to continue from, and whether the end-of-candidates has been reached.
 func ReceiveIceCandidates(ctx *gin.Context) {
 	// Extract parameters from request.
-	miiting, sdpType, _, err := extractParameters(ctx, true)
+	miiting, sdpType, token, err := extractParameters(ctx, true)
+	if err != nil {
+		return
+	}
+	participant := getParticipant(miiting, token)
+	link, err := getPeerLink(ctx, miiting, participant)
+	if err != nil {
+		return
+	}
+	round, err := getRound(ctx)
 	if err != nil {
 		return
 	}
 
-	// Get the channel cooresponding to our type from our miiting.
-	var iceCandidatesChan chan interface{}
-	if sdpType == "offer" {
-		iceCandidatesChan = miiting.offerIceChan
-	} else if sdpType == "answer" {
-		iceCandidatesChan = miiting.answerIceChan
-	} else {
+	// Validate the requested SDP type.
+	if sdpType != "offer" && sdpType != "answer" {
 		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
 			"Invalid SDP type: [%s]", sdpType)
 		return
 	}
 
-	// Read & wait for the SDP to be submitted by the other client.
-	var iceCandidates interface{}
-	select {
-	case iceCandidates = <-iceCandidatesChan:
-	case <-time.After(sdpWaitTimeout):
-	case <-miiting.ctx.Done():
+	// Get the number of candidates the client has already received.
+	cursor := 0
+	cursorParam, hasCursor := ctx.GetQuery("cursor")
+	if hasCursor {
+		if cursor, err = strconv.Atoi(cursorParam); err != nil || cursor < 0 {
+			abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+				"Invalid cursor: [%s]", cursorParam)
+			return
+		}
+	}
+
+	// Get the negotiation round we're waiting on.
+	waitCtx, cancel := context.WithTimeout(participant.ctx, sdpWaitTimeout)
+	defer cancel()
+	negotiation, err := awaitNegotiation(waitCtx, link, round)
+	if err != nil {
+		abortWithNegotiationError(ctx, err)
+		return
 	}
 
+	// Wait for ICE candidates to be submitted by the other client.
+	queue := negotiation.candidateQueue(sdpType)
+	iceCandidates, completed, err := queue.wait(waitCtx, cursor)
+
 	// Respond with error code if waiting for ICE candidates has timed out.
-	if iceCandidates == nil {
+	if err != nil {
 		abortWithStatusAndMessage(ctx, http.StatusGatewayTimeout,
 			"No ICE candidates received from peer")
 		return
 	}
 
 	// Respond with the received ICE candidates.
-	ctx.JSON(http.StatusOK, iceCandidates)
+	ctx.Header("X-Negotiation-Round", strconv.FormatInt(negotiation.Round, 10))
+	if !hasCursor {
+		ctx.JSON(http.StatusOK, iceCandidates)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"round":             negotiation.Round,
+		"ice_candidates":    iceCandidates,
+		"cursor":            cursor + len(iceCandidates),
+		"end_of_candidates": completed,
+	})
 }
 
-// SendIceCandidates is the handler for sending ICE candidates.
+// SendIceCandidates is the handler for sending ICE candidates. Candidates may
+// be trickled one at a time as they are gathered or sent in batches, followed
+// by an end-of-candidates marker once gathering has finished.
 func SendIceCandidates(ctx *gin.Context) {
 	// Extract parameters from request.
-	miiting, sdpType, _, err := extractParameters(ctx, true)
+	miiting, sdpType, token, err := extractParameters(ctx, true)
 	if err != nil {
 		return
 	}
+	participant := getParticipant(miiting, token)
+	link, err := getPeerLink(ctx, miiting, participant)
+	if err != nil {
+		return
+	}
+	round, err := getRound(ctx)
+	if err != nil {
+		return
+	}
+
+	// Validate the requested SDP type.
+	if sdpType != "offer" && sdpType != "answer" {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid SDP type: [%s]", sdpType)
+		return
+	}
 
 	// Prepare the struct to receive ICE candidates entity.
 	iceCandidatesEntity := struct {
-		IceCandidates []interface{} `json:"ice_candidates"`
-	}{nil}
+		IceCandidate    interface{}   `json:"ice_candidate"`
+		IceCandidates   []interface{} `json:"ice_candidates"`
+		EndOfCandidates bool          `json:"end_of_candidates"`
+	}{nil, nil, false}
 
 	// Extract the ICE candidates from request body.
 	if err := ctx.BindJSON(&iceCandidatesEntity); err != nil {
@@ -434,21 +911,35 @@ func SendIceCandidates(ctx *gin.Context) {
 		return
 	}
 
-	// Send the submitted ICE candidates over our miiting channel.
-	if sdpType == "offer" && miiting.offerIceChan != nil {
-		// Send the submitted ICE candidates over the offer channel.
-		miiting.offerIceChan <- iceCandidatesEntity.IceCandidates
-	} else if sdpType == "answer" && miiting.answerIceChan != nil {
-		// Send the submitted ICE candidates over the answer channel.
-		miiting.answerIceChan <- iceCandidatesEntity.IceCandidates
-	} else {
+	// Make sure there is at least something for us to do.
+	if iceCandidatesEntity.IceCandidate == nil &&
+		iceCandidatesEntity.IceCandidates == nil &&
+		!iceCandidatesEntity.EndOfCandidates {
 		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
-			"Invalid SDP type: [%s]", sdpType)
+			"No ICE candidates or end-of-candidates in request")
 		return
 	}
 
-	// Respond with empty JSON.
-	ctx.JSON(http.StatusOK, gin.H{})
+	// Collect the submitted candidates, single or batched.
+	iceCandidates := iceCandidatesEntity.IceCandidates
+	if iceCandidatesEntity.IceCandidate != nil {
+		iceCandidates = append(iceCandidates, iceCandidatesEntity.IceCandidate)
+	}
+
+	// Append the submitted ICE candidates to the requested round.
+	negotiation, cursor, err := submitCandidates(miiting, link, round,
+		participant.ID, sdpType, iceCandidates,
+		iceCandidatesEntity.EndOfCandidates)
+	if err != nil {
+		abortWithNegotiationError(ctx, err)
+		return
+	}
+
+	// Respond with the round and cursor after our ICE candidates.
+	ctx.JSON(http.StatusOK, gin.H{
+		"round":  negotiation.Round,
+		"cursor": cursor,
+	})
 }
 
 // serveMiitAsset responds with content of in-memory assets.
@@ -477,14 +968,21 @@ func extractParameters(ctx *gin.Context, typeRequired bool) (
 		return nil, "", "", errParameterExtractionFailed
 	}
 
+	// Verify the provided token before even looking up the miiting.
+	token := extractToken(ctx)
+	if _, err := verifyToken(token, miitingID); err != nil {
+		abortWithStatusAndMessage(ctx, http.StatusUnauthorized,
+			"Unauthorized token: %v", err)
+		return nil, "", "", errParameterExtractionFailed
+	}
+
 	// Lookup the requested miiting.
-	value, exists := miitings.Load(miitingID)
+	miiting, exists := store.Load(miitingID)
 	if !exists {
 		abortWithStatusAndMessage(ctx, http.StatusNotFound,
 			"Failed to find miiting [%s]", miitingID)
 		return nil, "", "", errParameterExtractionFailed
 	}
-	miiting := value.(*miiting)
 
 	// Get the requested SDP type from path params.
 	sdpType := ctx.Param("sdp_type")
@@ -494,11 +992,10 @@ func extractParameters(ctx *gin.Context, typeRequired bool) (
 		return nil, "", "", errParameterExtractionFailed
 	}
 
-	// Check if the provided token is valid.
-	token := ctx.Query("token")
+	// Check if the provided token belongs to a participant of the miiting.
 	if !tokenIsValid(miiting, token) {
 		abortWithStatusAndMessage(ctx, http.StatusUnauthorized,
-			"Unauthorized token: [%s]", token)
+			"Unauthorized token for miiting [%s]", miitingID)
 		return nil, "", "", errParameterExtractionFailed
 	}
 
@@ -510,38 +1007,76 @@ func miitingMonitor(miiting *miiting) {
 	// Keep a copy of miiting ID, since it may be deleted while sleeping.
 	miitingID := miiting.ID
 
-	// Setup miiting cleanup functions.
-	defer miitings.Delete(miitingID)
+	// Setup miiting cleanup functions, the miiting is kept in our store if
+	// we're only shutting down.
+	defer func() {
+		if global.Context.Err() != nil {
+			return
+		}
+		if err := store.Delete(miitingID); err != nil {
+			logging.Error("Failed to delete miiting [%s]: %v", miitingID, err)
+		}
+	}()
 	defer miiting.cancel()
+	defer miiting.events.close()
 	defer logging.Info("miiting [%s] monitor exited", miitingID)
 
 	// Keep monitoring miiting status until context is cancelled.
+	var warnedDeadline int64
 	for miiting.ctx.Err() == nil {
 		// Perform session timeout invalidation.
 		nowNano := int64(time.Now().UnixNano())
 		elapsed := nowNano - atomic.LoadInt64(&(miiting.Timestamp))
 		if elapsed > keepAliveTimeoutNanoseconds {
 			logging.Warn("miiting [%s] has timed-out", miitingID)
+			miiting.events.publish("", eventTypeMiitingTimedOut, nil)
+			return
+		}
+
+		// End the miiting once it has lasted for its maximum duration,
+		// warning the participants ahead. Extended deadlines are warned of
+		// again.
+		deadline := atomic.LoadInt64(&(miiting.Deadline))
+		if deadline > 0 && nowNano >= deadline {
+			logging.Warn("miiting [%s] has expired", miitingID)
+			miiting.events.publish("", eventTypeMiitingExpired, nil)
 			return
+		} else if deadline > 0 && warnedDeadline != deadline &&
+			nowNano >= deadline-durationWarning.Nanoseconds() {
+			miiting.events.publish("", eventTypeMiitingExpiring,
+				gin.H{"deadline": deadline})
+			warnedDeadline = deadline
 		}
 
-		// Perform individual participant timeout invalidation.
-		miiting.Tokens.Range(func(token, timestamp interface{}) bool {
-			elapsed := nowNano - timestamp.(int64)
+		// Perform individual participant timeout invalidation, evicting
+		// stale participants while the others carry on.
+		miiting.Tokens.Range(func(token, value interface{}) bool {
+			participant := value.(*participant)
+			elapsed := nowNano - atomic.LoadInt64(&(participant.Timestamp))
 			if elapsed > keepAliveTimeoutNanoseconds {
-				logging.Warn("Token [%s] of [%s] has timed-out",
-					token, miitingID)
-				miiting.cancel()
-				return false
+				logging.Warn("Participant [%s] of [%s] has timed-out",
+					participant.ID, miitingID)
+				removeParticipant(miiting, token.(string),
+					leaveReasonTimedOut)
 			}
 
 			return true
 		})
 
-		// Sleep until next invalidation check.
+		// Forget joiners who stopped waiting in the lobby, and departed
+		// participants who didn't resume in time. End the miiting if nobody
+		// is left.
+		expireLobby(miiting, nowNano)
+		if expireDeparted(miiting, nowNano) {
+			logging.Info("miiting [%s] has been deserted", miitingID)
+			return
+		}
+
+		// Sleep until the next heartbeat expires.
 		select {
-		case <-time.After(keepAliveTimeout):
+		case <-time.After(timeUntilExpiry(miiting)):
 		case <-miiting.deleteChan:
+			miiting.events.publish("", eventTypeMiitingDeleted, nil)
 			return
 		case <-miiting.ctx.Done():
 			return
@@ -549,6 +1084,282 @@ func miitingMonitor(miiting *miiting) {
 	}
 }
 
+// checkPasscode enforces the outcome of verifyPasscode on a new joiner,
+// counting failures per miiting and per client IP. Requests are aborted if
+// the passcode is invalid or they're being throttled.
+func checkPasscode(ctx *gin.Context, miiting *miiting, valid bool,
+	wait time.Duration) bool {
+	// Reject requests of clients who failed too often.
+	if wait > 0 {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		abortWithStatusAndMessage(ctx, http.StatusTooManyRequests,
+			"Too many failed passcode attempts for miiting [%s]", miiting.ID)
+		return false
+	}
+
+	// Count the failure if the passcode doesn't match.
+	if !valid {
+		passcodeThrottle.fail(passcodeThrottleKeys(ctx, miiting)...)
+		abortWithStatusAndMessage(ctx, http.StatusForbidden,
+			"Invalid passcode for miiting [%s]", miiting.ID)
+		return false
+	}
+
+	return true
+}
+
+// resolveCapacity returns the requested miiting capacity, or the default one
+// if none is requested. Requests are aborted if the capacity is invalid.
+func resolveCapacity(ctx *gin.Context, capacity int) (int, bool) {
+	if capacity == 0 {
+		return defaultCapacity, true
+	} else if capacity < 2 || capacity > maxCapacity {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid miiting capacity: [%d]", capacity)
+		return 0, false
+	}
+
+	return capacity, true
+}
+
+// timeUntilExpiry returns the time until the earliest heartbeat of a miiting
+// expires, be it of the miiting itself, a participant or a departed one, or
+// until the miiting is due to be warned of or reach its deadline.
+func timeUntilExpiry(miiting *miiting) time.Duration {
+	// Find the earliest heartbeat to expire.
+	nowNano := int64(time.Now().UnixNano())
+	expiry := atomic.LoadInt64(&(miiting.Timestamp)) +
+		keepAliveTimeoutNanoseconds
+	miiting.Tokens.Range(func(token, value interface{}) bool {
+		participant := value.(*participant)
+		timestamp := atomic.LoadInt64(&(participant.Timestamp))
+		if timestamp+keepAliveTimeoutNanoseconds < expiry {
+			expiry = timestamp + keepAliveTimeoutNanoseconds
+		}
+		return true
+	})
+	miiting.mutex.Lock()
+	for _, participant := range miiting.departed {
+		timestamp := atomic.LoadInt64(&(participant.Timestamp))
+		if timestamp+resumeGracePeriod.Nanoseconds() < expiry {
+			expiry = timestamp + resumeGracePeriod.Nanoseconds()
+		}
+	}
+	miiting.mutex.Unlock()
+
+	// Wake up to warn of the deadline and to end the miiting, if it has one.
+	if deadline := atomic.LoadInt64(&(miiting.Deadline)); deadline > 0 {
+		warning := deadline - durationWarning.Nanoseconds()
+		for _, moment := range []int64{warning, deadline} {
+			if moment > nowNano && moment < expiry {
+				expiry = moment
+			}
+		}
+	}
+
+	// Check again right after it expires.
+	return time.Duration(expiry-nowNano) + time.Millisecond
+}
+
+// refreshTimestamps marks both the miiting and the participant as alive.
+func refreshTimestamps(miiting *miiting, token string) {
+	nowNano := int64(time.Now().UnixNano())
+	if err := store.UpdateHeartbeat(miiting, token, nowNano); err != nil {
+		logging.Error("Failed to update heartbeat of [%s]: %v",
+			miiting.ID, err)
+	}
+}
+
+// newMiiting creates a miiting with the given capacity at the given time.
+func newMiiting(miitingID string, capacity int, timestamp int64) *miiting {
+	miiting := &miiting{
+		ID:           miitingID,
+		Timestamp:    timestamp,
+		Created:      timestamp,
+		Capacity:     capacity,
+		Tokens:       syncmap{},
+		links:        map[string]*link{},
+		departed:     map[string]*participant{},
+		pending:      map[string]*pendingParticipant{},
+		linksUpdated: make(chan struct{}),
+		deleteChan:   make(chan bool, 2),
+		events:       newEventHub(),
+	}
+	miiting.ctx, miiting.cancel = context.WithCancel(global.Context)
+
+	return miiting
+}
+
+// newParticipant creates a participant joining the miiting at the given time.
+func newParticipant(miiting *miiting, timestamp int64) *participant {
+	participant := &participant{
+		ID:            generateID(),
+		JoinTimestamp: timestamp,
+		Timestamp:     timestamp,
+		resumeToken:   generateID() + generateID(),
+	}
+	participant.ctx, participant.cancel = context.WithCancel(miiting.ctx)
+
+	return participant
+}
+
+// removeParticipant removes the participant with the given token from the
+// miiting, closing its links and connections and notifying its peers. The
+// slot of participants who timed out is kept for them to resume within the
+// grace period. The miiting is deleted once its last participant is removed.
+func removeParticipant(miiting *miiting, token string, reason string) {
+	// Remove the participant and its links, unless it's already gone.
+	miiting.mutex.Lock()
+	participant := getParticipant(miiting, token)
+	if participant == nil {
+		miiting.mutex.Unlock()
+		return
+	}
+	if err := store.Leave(miiting, token); err != nil {
+		logging.Error("Failed to free slot of [%s] in [%s]: %v",
+			participant.ID, miiting.ID, err)
+	}
+	closeLinks(miiting, participant.ID)
+	resumable := reason == leaveReasonTimedOut && resumeGracePeriod > 0
+	if resumable {
+		miiting.departed[participant.resumeToken] = participant
+	}
+	empty := occupiedSlotsCount(miiting) <= 0
+
+	// Hand host rights to whoever has been in the miiting the longest.
+	newHost := ""
+	if peers := getPeers(miiting, participant.ID); len(peers) > 0 &&
+		participant.ID == miiting.Host {
+		newHost = peers[0].ID
+		miiting.Host = newHost
+	}
+	miiting.mutex.Unlock()
+
+	// Hang up on the participant and let its peers know it's gone.
+	participant.cancel()
+	miiting.events.publish(participant.ID, eventTypePeerLeft, gin.H{
+		"peer":      participant,
+		"reason":    reason,
+		"resumable": resumable,
+	})
+	if len(newHost) > 0 {
+		updateMiiting(miiting)
+		miiting.events.publish("", eventTypeHostChanged,
+			gin.H{"host": newHost})
+	}
+
+	// Notify monitor to delete miiting, unless it already has been.
+	if empty {
+		select {
+		case miiting.deleteChan <- true:
+		default:
+		}
+	}
+}
+
+// resumeParticipant takes the participant with the given resume token out of
+// the miiting, be it still connected or departed within the grace period,
+// for it to be rejoined under a new token. The miiting mutex must be held by
+// the caller.
+func resumeParticipant(miiting *miiting, resumeToken string) *participant {
+	// Look for participants who departed first.
+	if participant, exists := miiting.departed[resumeToken]; exists {
+		delete(miiting.departed, resumeToken)
+		return participant
+	}
+
+	// Hang up on the stale connections of a participant still in the miiting.
+	var resumed *participant
+	miiting.Tokens.Range(func(token, value interface{}) bool {
+		participant := value.(*participant)
+		if participant.resumeToken != resumeToken {
+			return true
+		}
+		if err := store.Leave(miiting, token.(string)); err != nil {
+			logging.Error("Failed to free slot of [%s] in [%s]: %v",
+				participant.ID, miiting.ID, err)
+		}
+		participant.cancel()
+		resumed = participant
+		return false
+	})
+
+	return resumed
+}
+
+// expireDeparted forgets the departed participants of a miiting whose grace
+// period has elapsed, returning true if nobody is left in the miiting.
+func expireDeparted(miiting *miiting, nowNano int64) bool {
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+
+	for resumeToken, participant := range miiting.departed {
+		elapsed := nowNano - atomic.LoadInt64(&(participant.Timestamp))
+		if elapsed > resumeGracePeriod.Nanoseconds() {
+			delete(miiting.departed, resumeToken)
+		}
+	}
+
+	return occupiedSlotsCount(miiting) <= 0
+}
+
+// occupiedSlotsCount returns the number of participant slots of a miiting
+// occupied by its participants, including those who may still resume.
+func occupiedSlotsCount(miiting *miiting) int {
+	return mapEntriesCount(&miiting.Tokens) + len(miiting.departed)
+}
+
+// participantIsPresent checks if the participant with the given ID occupies a
+// slot of the miiting, be it connected or departed. The miiting mutex must be
+// held by the caller.
+func participantIsPresent(miiting *miiting, participantID string) bool {
+	if _, exists := findToken(miiting, participantID); exists {
+		return true
+	}
+	for _, participant := range miiting.departed {
+		if participant.ID == participantID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getParticipant returns the participant with the given token.
+func getParticipant(miiting *miiting, token string) *participant {
+	value, exists := miiting.Tokens.Load(token)
+	if !exists {
+		return nil
+	}
+
+	return value.(*participant)
+}
+
+// getPeers returns all participants except the one with the given ID, in the
+// order they joined the miiting.
+func getPeers(miiting *miiting, participantID string) []*participant {
+	peers := []*participant{}
+	miiting.Tokens.Range(func(token, value interface{}) bool {
+		if participant := value.(*participant); participant.ID != participantID {
+			peers = append(peers, participant)
+		}
+		return true
+	})
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].JoinTimestamp < peers[j].JoinTimestamp
+	})
+
+	return peers
+}
+
+// generateID generates a random identifier.
+func generateID() string {
+	bytes := make([]byte, 8)
+	cryptorand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
 // Check if the provided token is in our miiting tokens;
 func tokenIsValid(miiting *miiting, token string) bool {
 	// Iterate through all tokens in our miiting.
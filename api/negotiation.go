@@ -0,0 +1,488 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Negotiation error types to signal a signaling request doesn't fit the
+// current state of negotiation.
+var errStaleRound = errors.New("negotiation round is stale")
+var errInvalidRound = errors.New("negotiation round has not started")
+var errRoleConflict = errors.New("participant has the other role this round")
+var errMiitingEnded = errors.New("miiting has ended")
+var errPeerRequired = errors.New("peer must be specified")
+var errPeerNotFound = errors.New("peer not found")
+var errLinkClosed = errors.New("peer has left the miiting")
+var errTooManyRounds = errors.New("too many negotiation rounds")
+
+// link is the signaling relationship between two participants of a miiting.
+// The participant who joined first offers in the first negotiation round. A
+// link whose second participant is empty is pending, waiting to be bound to
+// the next participant joining the miiting. A link is closed once either of
+// its participants leaves.
+type link struct {
+	peers       [2]string
+	mutex       sync.Mutex
+	negotiation *negotiation
+	closed      chan struct{}
+}
+
+// negotiation is a numbered round of offer / answer exchange over a link. Each
+// round has its own descriptions and ICE candidates, and is started by whoever
+// offers first, so either side can renegotiate tracks or restart ICE.
+type negotiation struct {
+	Round          int64
+	offerer        string
+	offerMailbox   *mailbox
+	answerMailbox  *mailbox
+	offerIceQueue  *candidateQueue
+	answerIceQueue *candidateQueue
+	superseded     chan struct{}
+}
+
+// newLink creates a link between two participants, the first one offering.
+func newLink(offerer string, answerer string) *link {
+	return &link{
+		peers:       [2]string{offerer, answerer},
+		negotiation: newNegotiation(1, offerer),
+		closed:      make(chan struct{}),
+	}
+}
+
+// peer returns the ID of the other participant of the link.
+func (link *link) peer(participantID string) string {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	if link.peers[0] == participantID {
+		return link.peers[1]
+	}
+	return link.peers[0]
+}
+
+// linkKey returns the key of the link between two participants.
+func linkKey(participantID string, peerID string) string {
+	if participantID > peerID {
+		participantID, peerID = peerID, participantID
+	}
+	return participantID + ":" + peerID
+}
+
+// getLink returns the link between the participant and the peer with the
+// given ID, creating it if it doesn't exist yet. Without a peer ID, the link
+// to the only other participant is returned, or the pending link of the
+// participant if it is alone in the miiting.
+func getLink(miiting *miiting, participant *participant, peerID string) (
+	*link, error) {
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+
+	// Find our peers, ordered by the time they joined.
+	peers := getPeers(miiting, participant.ID)
+	if len(peerID) <= 0 {
+		if len(peers) > 1 {
+			return nil, errPeerRequired
+		} else if len(peers) == 1 {
+			peerID = peers[0].ID
+		}
+	}
+
+	// Make sure the peer is a participant of the miiting.
+	peerJoinTimestamp, peerExists := int64(0), false
+	for _, peer := range peers {
+		if peer.ID == peerID {
+			peerJoinTimestamp, peerExists = peer.JoinTimestamp, true
+		}
+	}
+	if len(peerID) > 0 && !peerExists {
+		return nil, errPeerNotFound
+	}
+
+	// Lookup or create the link, whoever joined first offers first.
+	key := linkKey(participant.ID, peerID)
+	if link, exists := miiting.links[key]; exists {
+		return link, nil
+	}
+	link := newLink(participant.ID, peerID)
+	if peerExists && peerJoinTimestamp <= participant.JoinTimestamp {
+		link = newLink(peerID, participant.ID)
+	}
+	miiting.links[key] = link
+	notifyLinksUpdated(miiting)
+
+	return link, nil
+}
+
+// bindPendingLinks binds the pending links of a miiting to the participant
+// who just joined, notifying it of any offers already waiting on them.
+func bindPendingLinks(miiting *miiting, participant *participant) {
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+
+	for key, link := range miiting.links {
+		// Skip links already established between two participants, and our
+		// own links still waiting for a peer if we rejoined or resumed.
+		link.mutex.Lock()
+		offerer := link.peers[0]
+		pending := len(link.peers[1]) <= 0 && offerer != participant.ID
+		if pending {
+			link.peers[1] = participant.ID
+		}
+		negotiation := link.negotiation
+		link.mutex.Unlock()
+		if !pending {
+			continue
+		}
+
+		// Re-key the link by its participants.
+		delete(miiting.links, key)
+		miiting.links[linkKey(offerer, participant.ID)] = link
+		notifyLinksUpdated(miiting)
+		if _, occupied, _ := negotiation.offerMailbox.peek(); occupied {
+			miiting.events.publishTo(participant.ID, offerer,
+				eventTypeOfferAvailable, gin.H{"round": negotiation.Round})
+		}
+	}
+}
+
+// restartLinks starts new negotiation rounds on the established links of a
+// participant who rejoined the miiting, offered by the participant if offer is
+// set, otherwise by the peers who stayed.
+func restartLinks(miiting *miiting, participant *participant, offer bool) {
+	links, _ := getLinks(miiting, participant.ID)
+	for _, link := range links {
+		// Skip links still pending for a peer to join.
+		peerID := link.peer(participant.ID)
+		if len(peerID) <= 0 {
+			continue
+		}
+
+		// Supersede the current round, unless someone just did.
+		offerer := peerID
+		if offer {
+			offerer = participant.ID
+		}
+		if current, err := getNegotiation(link, 0); err == nil {
+			startNegotiation(link, current.Round+1, offerer)
+		}
+	}
+}
+
+// closeLinks closes and removes all links of the participant. The miiting
+// mutex must be held by the caller.
+func closeLinks(miiting *miiting, participantID string) {
+	for key, link := range miiting.links {
+		link.mutex.Lock()
+		if link.peers[0] == participantID || link.peers[1] == participantID {
+			// Nothing more will be exchanged over the link.
+			close(link.closed)
+			current := link.negotiation
+			close(current.superseded)
+			current.offerIceQueue.append(nil, true)
+			current.answerIceQueue.append(nil, true)
+			delete(miiting.links, key)
+		}
+		link.mutex.Unlock()
+	}
+	notifyLinksUpdated(miiting)
+}
+
+// getLinks returns all links of the participant, and a channel closed when
+// the links of the miiting are updated.
+func getLinks(miiting *miiting, participantID string) ([]*link,
+	<-chan struct{}) {
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+
+	links := []*link{}
+	for _, link := range miiting.links {
+		link.mutex.Lock()
+		if link.peers[0] == participantID || link.peers[1] == participantID {
+			links = append(links, link)
+		}
+		link.mutex.Unlock()
+	}
+
+	return links, miiting.linksUpdated
+}
+
+// notifyLinksUpdated wakes up everyone waiting for the links of a miiting to
+// be updated. The miiting mutex must be held by the caller.
+func notifyLinksUpdated(miiting *miiting) {
+	close(miiting.linksUpdated)
+	miiting.linksUpdated = make(chan struct{})
+}
+
+// newNegotiation creates a negotiation round started by the offerer.
+func newNegotiation(round int64, offerer string) *negotiation {
+	return &negotiation{
+		Round:          round,
+		offerer:        offerer,
+		offerMailbox:   newMailbox(),
+		answerMailbox:  newMailbox(),
+		offerIceQueue:  newCandidateQueue(),
+		answerIceQueue: newCandidateQueue(),
+		superseded:     make(chan struct{}),
+	}
+}
+
+// mailbox returns the description mailbox of the given SDP type.
+func (negotiation *negotiation) mailbox(sdpType string) *mailbox {
+	switch sdpType {
+	case "offer":
+		return negotiation.offerMailbox
+	case "answer":
+		return negotiation.answerMailbox
+	}
+
+	return nil
+}
+
+// candidateQueue returns the candidate queue of the given SDP type.
+func (negotiation *negotiation) candidateQueue(
+	sdpType string) *candidateQueue {
+	switch sdpType {
+	case "offer":
+		return negotiation.offerIceQueue
+	case "answer":
+		return negotiation.answerIceQueue
+	}
+
+	return nil
+}
+
+// localType returns the SDP type the participant sends in this round.
+func (negotiation *negotiation) localType(participantID string) string {
+	if participantID == negotiation.offerer {
+		return "offer"
+	}
+	return "answer"
+}
+
+// remoteType returns the SDP type the participant receives in this round.
+func (negotiation *negotiation) remoteType(participantID string) string {
+	if participantID == negotiation.offerer {
+		return "answer"
+	}
+	return "offer"
+}
+
+// getNegotiation returns the given negotiation round of a link, or the
+// current one if round is 0.
+func getNegotiation(link *link, round int64) (*negotiation, error) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	select {
+	case <-link.closed:
+		return nil, errLinkClosed
+	default:
+	}
+
+	current := link.negotiation
+	switch {
+	case round == 0 || round == current.Round:
+		return current, nil
+	case round < current.Round:
+		return nil, errStaleRound
+	}
+
+	return nil, errInvalidRound
+}
+
+// awaitNegotiation returns the given negotiation round of a link, waiting for
+// it to be started if it is the next round.
+func awaitNegotiation(ctx context.Context, link *link, round int64) (
+	*negotiation, error) {
+	for {
+		current, err := getNegotiation(link, 0)
+		if err != nil {
+			return nil, err
+		}
+		negotiation, err := getNegotiation(link, round)
+		if err != errInvalidRound || round > current.Round+1 {
+			return negotiation, err
+		}
+
+		select {
+		case <-current.superseded:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// startNegotiation starts the next negotiation round of a link with the
+// participant as the offerer, superseding the current round. If the round
+// has just been started by someone else, that round is returned instead.
+func startNegotiation(link *link, round int64, offerer string) (
+	*negotiation, error) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	select {
+	case <-link.closed:
+		return nil, errLinkClosed
+	default:
+	}
+
+	current := link.negotiation
+	switch {
+	case round == current.Round:
+		return current, nil
+	case round < current.Round:
+		return nil, errStaleRound
+	case round > current.Round+1:
+		return nil, errInvalidRound
+	case round > maxNegotiationRounds:
+		return nil, errTooManyRounds
+	}
+
+	// Supersede the current round, nothing more will be exchanged in it.
+	link.negotiation = newNegotiation(round, offerer)
+	close(current.superseded)
+	current.offerIceQueue.append(nil, true)
+	current.answerIceQueue.append(nil, true)
+
+	return link.negotiation, nil
+}
+
+// submitDescription submits an offer or answer of the participant over the
+// link in the given round. Offers for the round after the current one start
+// that round. A description still waiting to be received is only replaced if
+// replace is set, otherwise errMailboxOccupied is returned.
+func submitDescription(miiting *miiting, link *link, round int64,
+	participantID string, sdpType string, sdp interface{}, replace bool) (
+	*negotiation, error) {
+	// Get the requested round, or start it if we're the one offering.
+	negotiation, err := getNegotiation(link, round)
+	if err == errInvalidRound && sdpType == "offer" {
+		negotiation, err = startNegotiation(link, round, participantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the offerer of the round may offer, and only its peer may answer.
+	if negotiation.localType(participantID) != sdpType {
+		return nil, errRoleConflict
+	}
+
+	// Only relay candidates may reach the peer in relay-only miitings.
+	if isRelayOnly(miiting) {
+		sdp = filterDescription(miiting, participantID, sdp)
+	}
+
+	// Leave the submitted description in the mailbox of the round.
+	if miiting.ctx.Err() != nil {
+		return nil, errMiitingEnded
+	}
+	if err := negotiation.mailbox(sdpType).put(sdp, replace); err != nil {
+		return nil, err
+	}
+
+	// Notify our peer that the description is ready to be received.
+	eventType := eventTypeOfferAvailable
+	if sdpType == "answer" {
+		eventType = eventTypeAnswerAvailable
+	}
+	miiting.events.publishTo(link.peer(participantID), participantID,
+		eventType, gin.H{"round": negotiation.Round})
+
+	return negotiation, nil
+}
+
+// submitCandidates appends ICE candidates of the given SDP type to the given
+// round of a link, returning the cursor after the appended candidates.
+func submitCandidates(miiting *miiting, link *link, round int64,
+	participantID string, sdpType string, candidates []interface{},
+	complete bool) (*negotiation, int, error) {
+	// Get the requested round, candidates may not start new rounds.
+	negotiation, err := getNegotiation(link, round)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Participants may only send the candidates of their own side.
+	if negotiation.localType(participantID) != sdpType {
+		return nil, 0, errRoleConflict
+	}
+
+	// Only relay candidates may reach the peer in relay-only miitings.
+	if isRelayOnly(miiting) {
+		candidates = filterCandidates(miiting, participantID, candidates)
+	}
+
+	// Append the candidates to the queue of the round.
+	cursor, err := negotiation.candidateQueue(sdpType).append(candidates,
+		complete)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Notify our peer that the candidates are ready to be received.
+	miiting.events.publishTo(link.peer(participantID), participantID,
+		eventTypeCandidatesAvailable, gin.H{
+			"round":    negotiation.Round,
+			"sdp_type": sdpType,
+			"cursor":   cursor,
+		})
+
+	return negotiation, cursor, nil
+}
+
+// getPeerLink extracts the optional peer ID from query params and returns the
+// link between the participant and that peer.
+func getPeerLink(ctx *gin.Context, miiting *miiting,
+	participant *participant) (*link, error) {
+	link, err := getLink(miiting, participant, ctx.Query("peer"))
+	if err != nil {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid peer [%s]: %v", ctx.Query("peer"), err)
+		return nil, errParameterExtractionFailed
+	}
+
+	return link, nil
+}
+
+// getRound extracts the optional negotiation round from query params.
+func getRound(ctx *gin.Context) (int64, error) {
+	roundParam, exists := ctx.GetQuery("round")
+	if !exists {
+		return 0, nil
+	}
+
+	// Make sure the round is a valid round number.
+	round, err := strconv.ParseInt(roundParam, 10, 64)
+	if err != nil || round <= 0 {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid negotiation round: [%s]", roundParam)
+		return 0, errParameterExtractionFailed
+	}
+
+	return round, nil
+}
+
+// abortWithNegotiationError aborts request processing with the status code
+// corresponding to the negotiation error.
+func abortWithNegotiationError(ctx *gin.Context, err error) {
+	status := http.StatusConflict
+	switch err {
+	case errInvalidRound:
+		status = http.StatusBadRequest
+	case errMiitingEnded, errLinkClosed:
+		status = http.StatusGone
+	case errTooManyCandidates:
+		status = http.StatusRequestEntityTooLarge
+	case context.Canceled, context.DeadlineExceeded:
+		status = http.StatusGatewayTimeout
+	}
+
+	abortWithStatusAndMessage(ctx, status, "Failed to negotiate: %v", err)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The size of the random salt hashed with miiting passcodes.
+const passcodeSaltSize = 16
+
+// The number of PBKDF2 iterations passcodes are hashed with, making guessing
+// passcodes from leaked hashes expensive.
+const passcodeIterations = 100000
+
+// setPasscode protects the miiting with the passcode. Only a salted hash of
+// the passcode is kept.
+func setPasscode(miiting *miiting, passcode string) {
+	miiting.passcodeSalt, miiting.passcodeHash = saltPasscode(passcode)
+}
+
+// saltPasscode returns a random salt and the hash of the passcode salted with
+// it, or nothing if the passcode is empty.
+func saltPasscode(passcode string) ([]byte, []byte) {
+	if len(passcode) <= 0 {
+		return nil, nil
+	}
+
+	salt := make([]byte, passcodeSaltSize)
+	cryptorand.Read(salt)
+	return salt, hashPasscode(salt, passcode)
+}
+
+// isProtected returns whether joining the miiting requires a passcode.
+func isProtected(miiting *miiting) bool {
+	return len(miiting.passcodeHash) > 0
+}
+
+// verifyPasscode checks the passcode against the one protecting the miiting,
+// unless the client has failed too often, returning how long it has to wait
+// then. Passcodes are set before miitings are stored and never change, so the
+// miiting mutex isn't needed.
+func verifyPasscode(ctx *gin.Context, miiting *miiting,
+	passcode string) (bool, time.Duration) {
+	if !isProtected(miiting) {
+		return true, 0
+	}
+
+	// Don't bother hashing for clients who failed too often.
+	keys := passcodeThrottleKeys(ctx, miiting)
+	if wait := passcodeThrottle.blocked(keys...); wait > 0 {
+		return false, wait
+	} else if len(passcode) <= 0 {
+		return false, 0
+	}
+
+	hash := hashPasscode(miiting.passcodeSalt, passcode)
+	return subtle.ConstantTimeCompare(hash, miiting.passcodeHash) == 1, 0
+}
+
+// passcodeThrottleKeys returns the keys passcode failures of the client are
+// counted under, its miiting and its IP.
+func passcodeThrottleKeys(ctx *gin.Context, miiting *miiting) []string {
+	return []string{"miiting:" + miiting.ID, "ip:" + ctx.ClientIP()}
+}
+
+// hashPasscode returns the salted hash of the passcode.
+func hashPasscode(salt []byte, passcode string) []byte {
+	return pbkdf2([]byte(passcode), salt, passcodeIterations, sha256.Size)
+}
+
+// pbkdf2 derives a key of the given length from the password and salt with
+// PBKDF2-HMAC-SHA256, see RFC 8018.
+func pbkdf2(password []byte, salt []byte, iterations int,
+	keyLength int) []byte {
+	mac := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLength+sha256.Size)
+	for index := uint32(1); len(key) < keyLength; index++ {
+		// The first iteration hashes the salt and the block index.
+		mac.Reset()
+		mac.Write(salt)
+		binary.Write(mac, binary.BigEndian, index)
+		block := mac.Sum(nil)
+
+		// XOR the result of each further iteration into the block.
+		result := append([]byte{}, block...)
+		for iteration := 1; iteration < iterations; iteration++ {
+			mac.Reset()
+			mac.Write(block)
+			block = mac.Sum(block[:0])
+			for idx := range result {
+				result[idx] ^= block[idx]
+			}
+		}
+		key = append(key, result...)
+	}
+
+	return key[:keyLength]
+}
+
+// failureThrottle throttles clients failing too often, e.g. when guessing
+// passcodes. Failures are counted per key within a fixed window, and keys
+// exceeding the maximum count are blocked until their window ends.
+type failureThrottle struct {
+	mutex       sync.Mutex
+	maxFailures int
+	window      time.Duration
+	failures    map[string]*failureCount
+}
+
+// failureCount is the number of failures of a key since the window started.
+type failureCount struct {
+	count int
+	start time.Time
+}
+
+// newFailureThrottle creates a throttle blocking keys with more than the
+// maximum failures within the window.
+func newFailureThrottle(maxFailures int,
+	window time.Duration) *failureThrottle {
+	return &failureThrottle{
+		maxFailures: maxFailures,
+		window:      window,
+		failures:    map[string]*failureCount{},
+	}
+}
+
+// blocked returns how long the first blocked key has still to wait, or 0 if
+// none of the keys is blocked.
+func (throttle *failureThrottle) blocked(keys ...string) time.Duration {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		failures, exists := throttle.failures[key]
+		if !exists || failures.count < throttle.maxFailures {
+			continue
+		}
+		if wait := failures.start.Add(throttle.window).Sub(now); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// fail counts a failure for each of the keys.
+func (throttle *failureThrottle) fail(keys ...string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	// Forget failures whose window has ended.
+	now := time.Now()
+	for key, failures := range throttle.failures {
+		if now.Sub(failures.start) >= throttle.window {
+			delete(throttle.failures, key)
+		}
+	}
+
+	// Count the failure within the window of each key.
+	for _, key := range keys {
+		failures, exists := throttle.failures[key]
+		if !exists {
+			failures = &failureCount{start: now}
+			throttle.failures[key] = failures
+		}
+		failures.count++
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestPBKDF2 checks PBKDF2-HMAC-SHA256 against the test vectors of RFC 7914,
+// section 11.
+func TestPBKDF2(t *testing.T) {
+	vectors := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605" +
+			"f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef31" +
+			"7c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9" +
+			"641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b317" +
+			"6a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, vector := range vectors {
+		key := pbkdf2([]byte(vector.password), []byte(vector.salt),
+			vector.iterations, len(vector.key)/2)
+		if encoded := hex.EncodeToString(key); encoded != vector.key {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", vector.password,
+				vector.salt, vector.iterations, encoded, vector.key)
+		}
+	}
+}
+
+// TestHashPasscode checks passcode hashes only match for the same passcode and
+// salt.
+func TestHashPasscode(t *testing.T) {
+	salt, otherSalt := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	hash := hex.EncodeToString(hashPasscode(salt, "passcode"))
+
+	tests := []struct {
+		salt     []byte
+		passcode string
+		matches  bool
+	}{
+		{salt, "passcode", true},
+		{salt, "Passcode", false},
+		{salt, "", false},
+		{otherSalt, "passcode", false},
+	}
+
+	for _, test := range tests {
+		encoded := hex.EncodeToString(hashPasscode(test.salt, test.passcode))
+		if (encoded == hash) != test.matches {
+			t.Errorf("hashPasscode(%q, %q) matches = %v, want %v", test.salt,
+				test.passcode, !test.matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jswirl/miit/config"
+	"github.com/jswirl/miit/logging"
+)
+
+// ICE candidate types. Only relay candidates don't reveal the addresses of
+// participants, mDNS candidates are host candidates with obfuscated addresses.
+const (
+	candidateTypeRelay     = "relay"
+	candidateTypeMDNS      = "mdns"
+	candidateTypeMalformed = "malformed"
+)
+
+// The keys of session descriptions holding SDP text, as sent by our clients
+// and as in the RTCSessionDescription of WebRTC.
+var descriptionKeys = []string{"description", "sdp"}
+
+// relayOnlyMode is the privacy mode of all miitings, where participants may
+// only exchange relay candidates.
+var relayOnlyMode bool
+
+func init() {
+	// Load configuration values.
+	relayOnlyMode = config.GetBool("MIIT_RELAY_ONLY")
+}
+
+// isRelayOnly checks if participants of the miiting may only exchange relay
+// candidates, either because the miiting asked for it or all miitings must.
+func isRelayOnly(miiting *miiting) bool {
+	return relayOnlyMode || miiting.RelayOnly
+}
+
+// filterDescription drops the candidates other than relay candidates embedded
+// in the session description sent by the participant.
+func filterDescription(miiting *miiting, participantID string,
+	sdp interface{}) interface{} {
+	filtered := map[string]int{}
+	defer logFilteredCandidates(miiting, participantID, filtered)
+
+	// Descriptions are either SDP text, or objects holding SDP text.
+	switch value := sdp.(type) {
+	case string:
+		return filterSDP(value, filtered)
+	case map[string]interface{}:
+		copied := map[string]interface{}{}
+		for key, field := range value {
+			copied[key] = field
+		}
+		for _, key := range descriptionKeys {
+			if text, ok := value[key].(string); ok {
+				copied[key] = filterSDP(text, filtered)
+			}
+		}
+		return copied
+	}
+
+	return sdp
+}
+
+// filterCandidates drops the candidates other than relay candidates from the
+// trickled candidates sent by the participant.
+func filterCandidates(miiting *miiting, participantID string,
+	candidates []interface{}) []interface{} {
+	filtered := map[string]int{}
+	defer logFilteredCandidates(miiting, participantID, filtered)
+
+	// Candidates are either candidate lines, or objects holding candidate
+	// lines as in the RTCIceCandidate of WebRTC. Empty candidate lines mark
+	// the end of candidates.
+	kept := []interface{}{}
+	for _, candidate := range candidates {
+		switch value := candidate.(type) {
+		case string:
+			if len(value) <= 0 {
+				kept = append(kept, value)
+			} else if line, ok := filterCandidate(value, filtered); ok {
+				kept = append(kept, line)
+			}
+		case map[string]interface{}:
+			text, _ := value["candidate"].(string)
+			if len(text) <= 0 {
+				kept = append(kept, value)
+				continue
+			}
+			line, ok := filterCandidate(text, filtered)
+			if !ok {
+				continue
+			}
+			copied := map[string]interface{}{}
+			for key, field := range value {
+				copied[key] = field
+			}
+			copied["candidate"] = line
+			kept = append(kept, copied)
+		default:
+			filtered[candidateTypeMalformed]++
+		}
+	}
+
+	return kept
+}
+
+// filterSDP drops the candidate lines other than relay candidates from the SDP
+// text, and masks the connection addresses which may reveal the address of a
+// host.
+func filterSDP(text string, filtered map[string]int) string {
+	lines := strings.SplitAfter(text, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		content := strings.TrimRight(line, "\r\n")
+		ending := line[len(content):]
+		if strings.HasPrefix(content, "a=candidate:") {
+			candidate, ok := filterCandidate(content, filtered)
+			if !ok {
+				continue
+			}
+			line = candidate + ending
+		} else if strings.HasPrefix(content, "c=") ||
+			strings.HasPrefix(content, "a=rtcp:") {
+			line = maskAddress(content) + ending
+		}
+		kept = append(kept, line)
+	}
+
+	return strings.Join(kept, "")
+}
+
+// filterCandidate checks if the candidate line is a relay candidate, returning
+// it with its related address masked. Candidates which are dropped are counted
+// by their type.
+func filterCandidate(line string, filtered map[string]int) (string, bool) {
+	// Candidate lines are formatted as "candidate:<foundation> <component>
+	// <transport> <priority> <address> <port> typ <type> [<extensions>]",
+	// optionally prefixed with "a=".
+	fields := strings.Fields(line)
+	if len(fields) < 8 || fields[6] != "typ" {
+		filtered[candidateTypeMalformed]++
+		return "", false
+	}
+	candidateType := strings.ToLower(fields[7])
+	if strings.HasSuffix(strings.ToLower(fields[4]), ".local") {
+		candidateType = candidateTypeMDNS
+	}
+	if candidateType != candidateTypeRelay {
+		filtered[candidateType]++
+		return "", false
+	}
+
+	// Relay candidates may still carry the address they were allocated for.
+	for idx := 8; idx+1 < len(fields); idx += 2 {
+		switch fields[idx] {
+		case "raddr":
+			fields[idx+1] = "0.0.0.0"
+		case "rport":
+			fields[idx+1] = "0"
+		}
+	}
+
+	return strings.Join(fields, " "), true
+}
+
+// maskAddress replaces the address at the end of a connection or RTCP line
+// with the unspecified address of its family.
+func maskAddress(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return line
+	}
+
+	switch fields[len(fields)-2] {
+	case "IP4":
+		fields[len(fields)-1] = "0.0.0.0"
+	case "IP6":
+		fields[len(fields)-1] = "::"
+	default:
+		return line
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// logFilteredCandidates logs the number of candidates of each type dropped
+// from what the participant sent in the miiting.
+func logFilteredCandidates(miiting *miiting, participantID string,
+	filtered map[string]int) {
+	if len(filtered) <= 0 {
+		return
+	}
+
+	counts := []string{}
+	for candidateType, count := range filtered {
+		counts = append(counts, fmt.Sprintf("%s=%d", candidateType, count))
+	}
+	sort.Strings(counts)
+	logging.Info("Filtered ICE candidates of [%s] in miiting [%s]: %s",
+		participantID, miiting.ID, strings.Join(counts, " "))
+}
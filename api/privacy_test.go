@@ -0,0 +1,149 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Sample candidate lines of each type.
+const (
+	hostCandidate  = "candidate:1 1 udp 2122260223 192.168.1.2 54400 typ host"
+	mdnsCandidate  = "candidate:2 1 udp 2122260223 4f1c.local 54401 typ host"
+	srflxCandidate = "candidate:3 1 udp 1686052607 203.0.113.4 54402 typ " +
+		"srflx raddr 192.168.1.2 rport 54400"
+	relayCandidate = "candidate:4 1 udp 41885439 198.51.100.5 3478 typ " +
+		"relay raddr 203.0.113.4 rport 54402 generation 0"
+	maskedRelay = "candidate:4 1 udp 41885439 198.51.100.5 3478 typ " +
+		"relay raddr 0.0.0.0 rport 0 generation 0"
+)
+
+// TestFilterCandidate checks only relay candidates are kept, with their
+// related address masked, and the others counted by type.
+func TestFilterCandidate(t *testing.T) {
+	tests := []struct {
+		line         string
+		kept         string
+		filteredType string
+	}{
+		{relayCandidate, maskedRelay, ""},
+		{"a=" + relayCandidate, "a=" + maskedRelay, ""},
+		{"candidate:4 1 udp 41885439 198.51.100.5 3478 typ RELAY",
+			"candidate:4 1 udp 41885439 198.51.100.5 3478 typ RELAY", ""},
+		{hostCandidate, "", "host"},
+		{mdnsCandidate, "", candidateTypeMDNS},
+		{srflxCandidate, "", "srflx"},
+		{"candidate:5 1 tcp 1518280447 192.168.1.2 9 typ prflx", "",
+			"prflx"},
+		{"candidate:6 1 udp 41885439 198.51.100.5 3478 relay", "",
+			candidateTypeMalformed},
+		{"candidate:7 1 udp 41885439 198.51.100.5 3478 type relay", "",
+			candidateTypeMalformed},
+	}
+
+	for _, test := range tests {
+		filtered := map[string]int{}
+		line, ok := filterCandidate(test.line, filtered)
+		if ok != (len(test.filteredType) <= 0) || line != test.kept {
+			t.Errorf("filterCandidate(%q) = %q, %v, want %q", test.line,
+				line, ok, test.kept)
+		}
+		if len(test.filteredType) > 0 && filtered[test.filteredType] != 1 {
+			t.Errorf("filterCandidate(%q) filtered = %v, want %s", test.line,
+				filtered, test.filteredType)
+		}
+	}
+}
+
+// TestFilterSDP checks non-relay candidate lines are dropped from SDP text,
+// and connection addresses masked, keeping the line endings.
+func TestFilterSDP(t *testing.T) {
+	sdp := "v=0\r\n" +
+		"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+		"m=audio 54400 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"c=IN IP4 203.0.113.4\r\n" +
+		"a=rtcp:54400 IN IP4 203.0.113.4\r\n" +
+		"a=" + hostCandidate + "\r\n" +
+		"a=" + mdnsCandidate + "\r\n" +
+		"a=" + srflxCandidate + "\r\n" +
+		"a=" + relayCandidate + "\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\n" +
+		"c=IN IP6 2001:db8::1\n" +
+		"a=end-of-candidates"
+	expected := "v=0\r\n" +
+		"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+		"m=audio 54400 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtcp:54400 IN IP4 0.0.0.0\r\n" +
+		"a=" + maskedRelay + "\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\n" +
+		"c=IN IP6 ::\n" +
+		"a=end-of-candidates"
+
+	filtered := map[string]int{}
+	if text := filterSDP(sdp, filtered); text != expected {
+		t.Errorf("filterSDP() = %q, want %q", text, expected)
+	}
+	if counts := (map[string]int{"host": 1, candidateTypeMDNS: 1,
+		"srflx": 1}); !reflect.DeepEqual(filtered, counts) {
+		t.Errorf("filterSDP() filtered = %v, want %v", filtered, counts)
+	}
+}
+
+// TestFilterCandidates checks trickled candidates are filtered whether they
+// are candidate lines or objects, keeping end-of-candidates markers.
+func TestFilterCandidates(t *testing.T) {
+	miiting := newMiiting("privacy", 2, 0)
+	candidates := []interface{}{
+		hostCandidate,
+		relayCandidate,
+		"",
+		map[string]interface{}{"candidate": srflxCandidate, "sdpMid": "0"},
+		map[string]interface{}{"candidate": relayCandidate, "sdpMid": "0"},
+		map[string]interface{}{"candidate": "", "sdpMid": "0"},
+		42.0,
+		nil,
+	}
+	expected := []interface{}{
+		maskedRelay,
+		"",
+		map[string]interface{}{"candidate": maskedRelay, "sdpMid": "0"},
+		map[string]interface{}{"candidate": "", "sdpMid": "0"},
+	}
+
+	kept := filterCandidates(miiting, "participant", candidates)
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("filterCandidates() = %v, want %v", kept, expected)
+	}
+	if candidates[4].(map[string]interface{})["candidate"] != relayCandidate {
+		t.Errorf("filterCandidates() modified the original candidates")
+	}
+}
+
+// TestFilterDescription checks the SDP text of descriptions is filtered
+// whether it's sent by itself or within an object.
+func TestFilterDescription(t *testing.T) {
+	miiting := newMiiting("privacy", 2, 0)
+	sdp := "a=" + hostCandidate + "\r\na=" + relayCandidate + "\r\n"
+	masked := "a=" + maskedRelay + "\r\n"
+
+	tests := []struct {
+		description interface{}
+		expected    interface{}
+	}{
+		{sdp, masked},
+		{map[string]interface{}{"type": "offer", "sdp": sdp},
+			map[string]interface{}{"type": "offer", "sdp": masked}},
+		{map[string]interface{}{"description": sdp, "round": 2.0},
+			map[string]interface{}{"description": masked, "round": 2.0}},
+		{42.0, 42.0},
+	}
+
+	for _, test := range tests {
+		filtered := filterDescription(miiting, "participant",
+			test.description)
+		if !reflect.DeepEqual(filtered, test.expected) {
+			t.Errorf("filterDescription(%v) = %v, want %v",
+				test.description, filtered, test.expected)
+		}
+	}
+}
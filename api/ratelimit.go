@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/api/middleware"
+	"github.com/jswirl/miit/config"
+)
+
+// The rate limiters of requests creating miitings or schedules, signaling
+// within miitings and accessing the admin API.
+var creationLimiter = loadRateLimiter("create", "MIIT_RATE_LIMIT_CREATE")
+var signalingLimiter = loadRateLimiter("signaling",
+	"MIIT_RATE_LIMIT_SIGNALING")
+var adminLimiter = loadRateLimiter("admin", "MIIT_RATE_LIMIT_ADMIN")
+
+func init() {
+	// Setup handlers for admin module.
+	getAdminGroup().GET("rate_limits", authorizeAdmin(adminScopeReadOnly),
+		ListRateLimits)
+}
+
+// ListRateLimits returns the state of all rate limiters.
+func ListRateLimits(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"rate_limits": []middleware.RateLimiterState{
+			creationLimiter.State(),
+			signalingLimiter.State(),
+			adminLimiter.State(),
+		},
+	})
+}
+
+// creationGroup returns a router group for the given path, whose requests are
+// limited by the creation rate limiter.
+func creationGroup(path string) *gin.RouterGroup {
+	return GetRoot().Group(path, middleware.RateLimit(creationLimiter))
+}
+
+// signalingGroup returns a router group for the given path, whose requests are
+// limited by the signaling rate limiter.
+func signalingGroup(path string) *gin.RouterGroup {
+	return GetRoot().Group(path, middleware.RateLimit(signalingLimiter))
+}
+
+// loadRateLimiter creates a rate limiter with the requests per minute & burst
+// size configured by the settings with the given prefix.
+func loadRateLimiter(name string, prefix string) *middleware.RateLimiter {
+	return middleware.NewRateLimiter(name,
+		config.GetInt(prefix+"_PER_MINUTE"), config.GetInt(prefix+"_BURST"))
+}
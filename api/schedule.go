@@ -0,0 +1,474 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jswirl/miit/config"
+	"github.com/jswirl/miit/global"
+	"github.com/jswirl/miit/logging"
+)
+
+// schedule is a miiting planned for a time window. The miiting is created with
+// the scheduled settings once someone joins within the window, and ends when
+// the window closes.
+type schedule struct {
+	scheduleRecord
+	mutex   sync.Mutex
+	updated chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// scheduleRecord is the persisted form of a schedule. The host is the
+// participant ID of the creator, who hosts the miiting and manages the
+// schedule with the token it was issued.
+type scheduleRecord struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title,omitempty"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+	Capacity     int       `json:"capacity"`
+	Lobby        bool      `json:"lobby"`
+	RelayOnly    bool      `json:"relay_only"`
+	Host         string    `json:"host"`
+	PasscodeSalt []byte    `json:"passcode_salt,omitempty"`
+	PasscodeHash []byte    `json:"passcode_hash,omitempty"`
+}
+
+// schedules holds all scheduled miitings whose window hasn't closed yet. New
+// schedules are stored under the mutex, so there are never more than allowed.
+var schedules syncmap
+var schedulesMutex sync.Mutex
+
+// Schedule configurations, limiting how long, how far ahead and how many
+// miitings may be scheduled, as anyone may reserve miiting IDs this way.
+var maxScheduleWindow time.Duration
+var maxScheduleLeadTime time.Duration
+var maxSchedules int
+
+func init() {
+	// Load configuration values.
+	maxScheduleWindow = config.GetMilliseconds("MIIT_SCHEDULE_MAX_WINDOW")
+	maxScheduleLeadTime = config.GetMilliseconds("MIIT_SCHEDULE_MAX_LEAD_TIME")
+	maxSchedules = config.GetInt("MIIT_SCHEDULE_MAX_PENDING")
+
+	// Setup handlers for scheduling miitings.
+	creationGroup("schedules").POST("", CreateSchedule)
+	schedulesGroup := signalingGroup("schedules")
+	schedulesGroup.GET(":schedule", GetSchedule)
+	schedulesGroup.PATCH(":schedule", UpdateSchedule)
+	schedulesGroup.DELETE(":schedule", CancelSchedule)
+
+	// Setup handlers for admin module.
+	getAdminGroup().GET("schedules", authorizeAdmin(adminScopeReadOnly),
+		ListSchedules)
+}
+
+// CreateSchedule is the handler for requests scheduling a miiting. The creator
+// is issued a token valid until the window closes, to manage the schedule and
+// to join the miiting as its host.
+func CreateSchedule(ctx *gin.Context) {
+	// Get schedule settings from request body.
+	body := struct {
+		ID        string    `json:"id"`
+		Title     string    `json:"title"`
+		Passcode  string    `json:"passcode"`
+		StartTime time.Time `json:"start_time"`
+		EndTime   time.Time `json:"end_time"`
+		Capacity  int       `json:"capacity"`
+		Lobby     bool      `json:"lobby"`
+		RelayOnly bool      `json:"relay_only"`
+	}{}
+	if err := ctx.BindJSON(&body); err != nil {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Failed to unmarshal schedule creation request: %v", err)
+		return
+	}
+	if len(body.ID) <= 0 {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid miiting ID: [%s]", body.ID)
+		return
+	}
+	capacity, valid := resolveCapacity(ctx, body.Capacity)
+	if !valid || !windowIsValid(ctx, body.StartTime, body.EndTime) {
+		return
+	}
+
+	// Schedule the miiting, unless it's already scheduled or ongoing, or too
+	// many miitings are.
+	record := scheduleRecord{
+		ID:        body.ID,
+		Title:     body.Title,
+		StartTime: body.StartTime,
+		EndTime:   body.EndTime,
+		Capacity:  capacity,
+		Lobby:     body.Lobby,
+		RelayOnly: body.RelayOnly,
+		Host:      generateID(),
+	}
+	record.PasscodeSalt, record.PasscodeHash = saltPasscode(body.Passcode)
+	schedule := newSchedule(&record)
+	if _, exists := store.Load(body.ID); exists {
+		schedule.cancel()
+		abortWithStatusAndMessage(ctx, http.StatusConflict,
+			"Miiting [%s] is ongoing", body.ID)
+		return
+	}
+	schedulesMutex.Lock()
+	if schedulesCount() >= maxSchedules {
+		schedulesMutex.Unlock()
+		schedule.cancel()
+		abortWithStatusAndMessage(ctx, http.StatusTooManyRequests,
+			"Too many scheduled miitings")
+		return
+	}
+	_, exists := schedules.LoadOrStore(body.ID, schedule)
+	schedulesMutex.Unlock()
+	if exists {
+		schedule.cancel()
+		abortWithStatusAndMessage(ctx, http.StatusConflict,
+			"Miiting [%s] is already scheduled", body.ID)
+		return
+	}
+	go scheduleMonitor(schedule)
+
+	response := describeScheduleRecord(&record)
+	response["token"] = mintToken(record.ID, record.Host, record.EndTime)
+	ctx.JSON(http.StatusCreated, response)
+}
+
+// ListSchedules returns the list of all scheduled miitings, in the order they
+// start.
+func ListSchedules(ctx *gin.Context) {
+	// Collect all schedules.
+	entries := []gin.H{}
+	schedules.Range(func(key, value interface{}) bool {
+		entries = append(entries, describeSchedule(value.(*schedule)))
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i]["start_time"].(time.Time).Before(
+			entries[j]["start_time"].(time.Time))
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{"schedules": entries})
+}
+
+// GetSchedule is the handler for the owner getting the settings of a scheduled
+// miiting.
+func GetSchedule(ctx *gin.Context) {
+	// Extract parameters from request.
+	schedule, err := extractScheduleParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, describeSchedule(schedule))
+}
+
+// UpdateSchedule is the handler for the owner updating a scheduled miiting.
+// Settings apply to the miiting when it's created, changes to the end of the
+// window also apply to the ongoing miiting. The owner is issued a new token
+// valid until the updated window closes.
+func UpdateSchedule(ctx *gin.Context) {
+	// Extract parameters from request.
+	schedule, err := extractScheduleParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Get the settings to update from request body.
+	body := struct {
+		Title     *string    `json:"title"`
+		Passcode  *string    `json:"passcode"`
+		StartTime *time.Time `json:"start_time"`
+		EndTime   *time.Time `json:"end_time"`
+		Capacity  *int       `json:"capacity"`
+		Lobby     *bool      `json:"lobby"`
+		RelayOnly *bool      `json:"relay_only"`
+	}{}
+	if err := ctx.BindJSON(&body); err != nil {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Failed to unmarshal schedule update request: %v", err)
+		return
+	}
+
+	// Validate the updated settings before applying any of them.
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	startTime, endTime := schedule.StartTime, schedule.EndTime
+	if body.StartTime != nil {
+		startTime = *body.StartTime
+	}
+	if body.EndTime != nil {
+		endTime = *body.EndTime
+	}
+	if !windowIsValid(ctx, startTime, endTime) {
+		return
+	}
+	capacity := schedule.Capacity
+	if body.Capacity != nil {
+		var valid bool
+		if capacity, valid = resolveCapacity(ctx, *body.Capacity); !valid {
+			return
+		}
+	}
+
+	// Apply the settings and wake the monitor up for the new window.
+	schedule.StartTime, schedule.EndTime = startTime, endTime
+	schedule.Capacity = capacity
+	if body.Title != nil {
+		schedule.Title = *body.Title
+	}
+	if body.Passcode != nil {
+		schedule.PasscodeSalt, schedule.PasscodeHash =
+			saltPasscode(*body.Passcode)
+	}
+	if body.Lobby != nil {
+		schedule.Lobby = *body.Lobby
+	}
+	if body.RelayOnly != nil {
+		schedule.RelayOnly = *body.RelayOnly
+	}
+	select {
+	case schedule.updated <- struct{}{}:
+	default:
+	}
+
+	response := describeScheduleRecord(&schedule.scheduleRecord)
+	response["token"] = mintToken(schedule.ID, schedule.Host, endTime)
+	ctx.JSON(http.StatusOK, response)
+}
+
+// CancelSchedule is the handler for the owner cancelling a scheduled miiting,
+// which also ends the miiting if it's ongoing.
+func CancelSchedule(ctx *gin.Context) {
+	// Extract parameters from request.
+	schedule, err := extractScheduleParameters(ctx)
+	if err != nil {
+		return
+	}
+
+	// Forget the schedule and end its miiting.
+	schedules.Delete(schedule.ID)
+	schedule.cancel()
+	endMiiting(schedule.ID)
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
+
+// extractScheduleParameters extracts the schedule a request was made for,
+// making sure it was made by the owner of the schedule.
+func extractScheduleParameters(ctx *gin.Context) (*schedule, error) {
+	// Get the schedule and the token from request.
+	scheduleID := ctx.Param("schedule")
+	token := extractToken(ctx)
+	value, exists := schedules.Load(scheduleID)
+	if !exists {
+		abortWithStatusAndMessage(ctx, http.StatusNotFound,
+			"Failed to find scheduled miiting [%s]", scheduleID)
+		return nil, errParameterExtractionFailed
+	}
+
+	// Only the owner is allowed to proceed.
+	schedule := value.(*schedule)
+	if err := checkScheduleOwner(schedule, token); err != nil {
+		abortWithStatusAndMessage(ctx, http.StatusUnauthorized,
+			"Unauthorized token: %v", err)
+		return nil, errParameterExtractionFailed
+	}
+
+	return schedule, nil
+}
+
+// scheduleMonitor ends the scheduled miiting once its window closes. The
+// schedule is kept if we're only shutting down.
+func scheduleMonitor(schedule *schedule) {
+	defer logging.Info("schedule [%s] monitor exited", schedule.ID)
+
+	// Sleep until the window closes, or the schedule is updated.
+	for {
+		schedule.mutex.Lock()
+		endTime := schedule.EndTime
+		schedule.mutex.Unlock()
+
+		select {
+		case <-time.After(time.Until(endTime)):
+			logging.Info("scheduled miiting [%s] has ended", schedule.ID)
+			schedules.Delete(schedule.ID)
+			endMiiting(schedule.ID)
+			return
+		case <-schedule.updated:
+		case <-schedule.ctx.Done():
+			return
+		}
+	}
+}
+
+// loadSchedule returns the schedule of the miiting with the given ID.
+func loadSchedule(miitingID string) (*schedule, bool) {
+	value, exists := schedules.Load(miitingID)
+	if !exists {
+		return nil, false
+	}
+
+	return value.(*schedule), true
+}
+
+// checkSchedule checks that the scheduled miiting is within its window.
+// Requests are aborted with the start time if the window hasn't opened yet.
+func checkSchedule(ctx *gin.Context, schedule *schedule) bool {
+	schedule.mutex.Lock()
+	startTime, endTime := schedule.StartTime, schedule.EndTime
+	schedule.mutex.Unlock()
+
+	// Tell clients coming early when to come back.
+	now := time.Now()
+	if now.Before(startTime) {
+		retryAfter := int(math.Ceil(startTime.Sub(now).Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		abortWithStatusAndDetails(ctx, http.StatusForbidden,
+			gin.H{"start_time": startTime},
+			"Miiting [%s] has not started yet", schedule.ID)
+		return false
+	} else if !now.Before(endTime) {
+		abortWithStatusAndMessage(ctx, http.StatusGone,
+			"Miiting [%s] has ended", schedule.ID)
+		return false
+	}
+
+	return true
+}
+
+// applySchedule applies the scheduled settings to the miiting.
+func applySchedule(miiting *miiting, schedule *schedule) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	miiting.Title, miiting.Host = schedule.Title, schedule.Host
+	miiting.Capacity = schedule.Capacity
+	miiting.Lobby = schedule.Lobby
+	miiting.RelayOnly = schedule.RelayOnly
+	miiting.passcodeSalt = schedule.PasscodeSalt
+	miiting.passcodeHash = schedule.PasscodeHash
+}
+
+// checkScheduleOwner checks that the token was issued to the owner of the
+// schedule.
+func checkScheduleOwner(schedule *schedule, token string) error {
+	claims, err := verifyToken(token, schedule.ID)
+	if err != nil {
+		return err
+	}
+
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	if claims.ParticipantID != schedule.Host {
+		return errTokenNotOwner
+	}
+
+	return nil
+}
+
+// windowIsValid checks that the window of a schedule hasn't closed yet, and
+// closes after it opens. The window may neither open too far ahead nor last
+// too long. Requests are aborted if it's invalid.
+func windowIsValid(ctx *gin.Context, startTime time.Time,
+	endTime time.Time) bool {
+	window := fmt.Sprintf("[%s, %s]", startTime.Format(time.RFC3339),
+		endTime.Format(time.RFC3339))
+	if !endTime.After(startTime) || !endTime.After(time.Now()) {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Invalid schedule window: %s", window)
+		return false
+	} else if time.Until(startTime) > maxScheduleLeadTime {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Schedule window %s opens later than %v from now", window,
+			maxScheduleLeadTime)
+		return false
+	} else if endTime.Sub(startTime) > maxScheduleWindow {
+		abortWithStatusAndMessage(ctx, http.StatusBadRequest,
+			"Schedule window %s is longer than %v", window,
+			maxScheduleWindow)
+		return false
+	}
+
+	return true
+}
+
+// schedulesCount returns the number of scheduled miitings.
+func schedulesCount() int {
+	count := 0
+	schedules.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+
+	return count
+}
+
+// describeSchedule returns the description of the schedule shown to clients.
+func describeSchedule(schedule *schedule) gin.H {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	return describeScheduleRecord(&schedule.scheduleRecord)
+}
+
+// describeScheduleRecord returns the description of the schedule record shown
+// to clients, leaving out its passcode.
+func describeScheduleRecord(record *scheduleRecord) gin.H {
+	return gin.H{
+		"id":         record.ID,
+		"title":      record.Title,
+		"start_time": record.StartTime,
+		"end_time":   record.EndTime,
+		"capacity":   record.Capacity,
+		"lobby":      record.Lobby,
+		"relay_only": record.RelayOnly,
+		"host":       record.Host,
+		"protected":  len(record.PasscodeHash) > 0,
+	}
+}
+
+// recordSchedule returns the persisted form of the schedule.
+func recordSchedule(schedule *schedule) scheduleRecord {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	return schedule.scheduleRecord
+}
+
+// newSchedule creates a schedule from its record.
+func newSchedule(record *scheduleRecord) *schedule {
+	schedule := &schedule{
+		scheduleRecord: *record,
+		updated:        make(chan struct{}, 1),
+	}
+	schedule.ctx, schedule.cancel = context.WithCancel(global.Context)
+
+	return schedule
+}
+
+// endMiiting notifies the monitor of the miiting with the given ID to end it,
+// if it's ongoing.
+func endMiiting(miitingID string) {
+	miiting, exists := store.Load(miitingID)
+	if !exists {
+		return
+	}
+
+	select {
+	case miiting.deleteChan <- true:
+	default:
+	}
+}
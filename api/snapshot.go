@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jswirl/miit/logging"
+)
+
+// snapshot is the state of all live and scheduled miitings saved on shutdown,
+// for the next server instance to resume them.
+type snapshot struct {
+	Timestamp int64             `json:"timestamp"`
+	Miitings  []miitingSnapshot `json:"miitings"`
+	Schedules []scheduleRecord  `json:"schedules"`
+}
+
+// miitingSnapshot is the saved state of a miiting, including the departed
+// participants who may still resume and the pending signals of its links.
+type miitingSnapshot struct {
+	miitingRecord
+	Departed []participantRecord `json:"departed"`
+	Links    []linkSnapshot      `json:"links"`
+}
+
+// linkSnapshot is the saved state of the current negotiation round of a link.
+// Descriptions are only saved while they're still waiting to be received.
+type linkSnapshot struct {
+	Peers                     [2]string     `json:"peers"`
+	Round                     int64         `json:"round"`
+	Offerer                   string        `json:"offerer"`
+	Offer                     interface{}   `json:"offer,omitempty"`
+	Answer                    interface{}   `json:"answer,omitempty"`
+	OfferCandidates           []interface{} `json:"offer_candidates"`
+	OfferCandidatesCompleted  bool          `json:"offer_candidates_completed"`
+	AnswerCandidates          []interface{} `json:"answer_candidates"`
+	AnswerCandidatesCompleted bool          `json:"answer_candidates_completed"`
+}
+
+// SaveSnapshot saves the state of all live and scheduled miitings to the
+// snapshot file, if one is configured.
+func SaveSnapshot() error {
+	if len(snapshotPath) <= 0 {
+		return nil
+	}
+
+	// Take a snapshot of every miiting in our store.
+	saved := snapshot{
+		Timestamp: time.Now().UnixNano(),
+		Miitings:  []miitingSnapshot{},
+		Schedules: []scheduleRecord{},
+	}
+	for _, miiting := range store.List() {
+		saved.Miitings = append(saved.Miitings, snapshotMiiting(miiting))
+	}
+	schedules.Range(func(key, value interface{}) bool {
+		saved.Schedules = append(saved.Schedules,
+			recordSchedule(value.(*schedule)))
+		return true
+	})
+
+	// Write the snapshot to a temporary file first, so we never leave a
+	// partially written snapshot behind.
+	content, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+	temporaryPath := snapshotPath + ".tmp"
+	if err := ioutil.WriteFile(temporaryPath, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temporaryPath, snapshotPath); err != nil {
+		return err
+	}
+
+	logging.Info("Saved snapshot of %d miitings and %d schedules to %s",
+		len(saved.Miitings), len(saved.Schedules), snapshotPath)
+	return nil
+}
+
+// restoreSnapshot restores the miitings saved in the snapshot file into our
+// store, replacing any stored miitings with the same IDs, and reschedules the
+// scheduled ones. The heartbeats of
+// restored miitings are shifted by the time we were down, so they keep the
+// keep-alive budget they had left. The snapshot is removed once restored.
+func restoreSnapshot() error {
+	if len(snapshotPath) <= 0 {
+		return nil
+	}
+
+	// Read the snapshot, if we left one behind.
+	content, err := ioutil.ReadFile(snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := snapshot{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return err
+	}
+
+	// Restore each miiting with the time we were down added to heartbeats.
+	downtime := time.Now().UnixNano() - saved.Timestamp
+	if downtime < 0 {
+		downtime = 0
+	}
+	for _, miitingSnapshot := range saved.Miitings {
+		miiting := restoreMiitingSnapshot(&miitingSnapshot, downtime)
+		if stale, exists := store.Load(miiting.ID); exists {
+			stale.cancel()
+			store.Delete(stale.ID)
+		}
+		if _, _, err := store.Create(miiting); err != nil {
+			miiting.cancel()
+			return err
+		}
+	}
+
+	// Reschedule the scheduled miitings, their monitors end any of them whose
+	// window closed while we were down.
+	for _, record := range saved.Schedules {
+		schedule := newSchedule(&record)
+		schedules.Store(schedule.ID, schedule)
+		go scheduleMonitor(schedule)
+	}
+
+	logging.Info("Restored snapshot of %d miitings and %d schedules from %s",
+		len(saved.Miitings), len(saved.Schedules), snapshotPath)
+	return os.Remove(snapshotPath)
+}
+
+// snapshotMiiting takes a snapshot of the miiting.
+func snapshotMiiting(miiting *miiting) miitingSnapshot {
+	miiting.mutex.Lock()
+	defer miiting.mutex.Unlock()
+
+	saved := miitingSnapshot{
+		miitingRecord: *recordMiiting(miiting),
+		Departed:      []participantRecord{},
+		Links:         []linkSnapshot{},
+	}
+	for _, participant := range miiting.departed {
+		saved.Departed = append(saved.Departed,
+			recordParticipant(participant))
+	}
+	for _, link := range miiting.links {
+		saved.Links = append(saved.Links, snapshotLink(link))
+	}
+
+	return saved
+}
+
+// snapshotLink takes a snapshot of the current negotiation round of the link.
+func snapshotLink(link *link) linkSnapshot {
+	link.mutex.Lock()
+	peers, negotiation := link.peers, link.negotiation
+	link.mutex.Unlock()
+
+	saved := linkSnapshot{
+		Peers:   peers,
+		Round:   negotiation.Round,
+		Offerer: negotiation.offerer,
+	}
+	if offer, occupied, _ := negotiation.offerMailbox.peek(); occupied {
+		saved.Offer = offer
+	}
+	if answer, occupied, _ := negotiation.answerMailbox.peek(); occupied {
+		saved.Answer = answer
+	}
+	saved.OfferCandidates, saved.OfferCandidatesCompleted, _ =
+		negotiation.offerIceQueue.after(0)
+	saved.AnswerCandidates, saved.AnswerCandidatesCompleted, _ =
+		negotiation.answerIceQueue.after(0)
+
+	return saved
+}
+
+// restoreMiitingSnapshot recreates a live miiting from its snapshot, adding
+// the downtime to all of its heartbeats.
+func restoreMiitingSnapshot(saved *miitingSnapshot, downtime int64) *miiting {
+	miiting := restoreMiiting(&saved.miitingRecord)
+	atomic.AddInt64(&(miiting.Timestamp), downtime)
+	miiting.Tokens.Range(func(token, value interface{}) bool {
+		atomic.AddInt64(&(value.(*participant).Timestamp), downtime)
+		return true
+	})
+
+	// Restore the departed participants who may still resume.
+	for _, record := range saved.Departed {
+		participant := restoreParticipant(miiting, &record)
+		participant.Timestamp += downtime
+		participant.cancel()
+		miiting.departed[participant.resumeToken] = participant
+	}
+
+	// Restore the links with their pending signals.
+	for _, linkSnapshot := range saved.Links {
+		link := newLink(linkSnapshot.Peers[0], linkSnapshot.Peers[1])
+		negotiation := newNegotiation(linkSnapshot.Round,
+			linkSnapshot.Offerer)
+		if linkSnapshot.Offer != nil {
+			negotiation.offerMailbox.put(linkSnapshot.Offer, false)
+		}
+		if linkSnapshot.Answer != nil {
+			negotiation.answerMailbox.put(linkSnapshot.Answer, false)
+		}
+		negotiation.offerIceQueue.append(linkSnapshot.OfferCandidates,
+			linkSnapshot.OfferCandidatesCompleted)
+		negotiation.answerIceQueue.append(linkSnapshot.AnswerCandidates,
+			linkSnapshot.AnswerCandidatesCompleted)
+		link.negotiation = negotiation
+		miiting.links[linkKey(link.peers[0], link.peers[1])] = link
+	}
+
+	return miiting
+}
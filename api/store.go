@@ -0,0 +1,251 @@
+package api
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// MiitingStore is the storage of miitings and their participant slots. The
+// miitings it returns are live objects, their signaling state is only ever
+// kept in memory.
+type MiitingStore interface {
+	// Create stores the miiting unless one with the same ID already exists,
+	// returning the stored miiting and whether it already existed.
+	Create(miiting *miiting) (*miiting, bool, error)
+
+	// Load returns the miiting with the given ID.
+	Load(miitingID string) (*miiting, bool)
+
+	// Join stores the participant in a slot of the miiting under the token.
+	// The miiting mutex must be held by the caller.
+	Join(miiting *miiting, token string, participant *participant) error
+
+	// Leave frees the slot of the participant with the token. The miiting
+	// mutex must be held by the caller.
+	Leave(miiting *miiting, token string) error
+
+	// Update persists changes to the metadata of the miiting.
+	Update(miiting *miiting) error
+
+	// UpdateHeartbeat marks the miiting and the participant with the token as
+	// alive at the given time.
+	UpdateHeartbeat(miiting *miiting, token string, timestamp int64) error
+
+	// Delete removes the miiting with the given ID.
+	Delete(miitingID string) error
+
+	// List returns all stored miitings.
+	List() []*miiting
+}
+
+// Types of miiting stores.
+const (
+	storeTypeMemory = "memory"
+	storeTypeBolt   = "bolt"
+)
+
+// openMiitingStore opens a miiting store of the given type. Persistent stores
+// are kept in the file at the given path.
+func openMiitingStore(storeType string, path string) (MiitingStore, error) {
+	switch storeType {
+	case storeTypeMemory:
+		return newMemoryStore(), nil
+	case storeTypeBolt:
+		return openBoltStore(path)
+	}
+
+	return nil, fmt.Errorf("invalid miiting store type: [%s]", storeType)
+}
+
+// memoryStore is the miiting store keeping miitings in memory only.
+type memoryStore struct {
+	miitings syncmap
+}
+
+// newMemoryStore creates an empty in-memory miiting store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+// Create implements MiitingStore.
+func (store *memoryStore) Create(created *miiting) (*miiting, bool, error) {
+	value, exists := store.miitings.LoadOrStore(created.ID, created)
+	return value.(*miiting), exists, nil
+}
+
+// Load implements MiitingStore.
+func (store *memoryStore) Load(miitingID string) (*miiting, bool) {
+	value, exists := store.miitings.Load(miitingID)
+	if !exists {
+		return nil, false
+	}
+
+	return value.(*miiting), true
+}
+
+// Join implements MiitingStore.
+func (store *memoryStore) Join(miiting *miiting, token string,
+	participant *participant) error {
+	miiting.Tokens.Store(token, participant)
+	return nil
+}
+
+// Leave implements MiitingStore.
+func (store *memoryStore) Leave(miiting *miiting, token string) error {
+	miiting.Tokens.Delete(token)
+	return nil
+}
+
+// Update implements MiitingStore.
+func (store *memoryStore) Update(miiting *miiting) error {
+	return nil
+}
+
+// UpdateHeartbeat implements MiitingStore.
+func (store *memoryStore) UpdateHeartbeat(miiting *miiting, token string,
+	timestamp int64) error {
+	atomic.StoreInt64(&(miiting.Timestamp), timestamp)
+	if participant := getParticipant(miiting, token); participant != nil {
+		atomic.StoreInt64(&(participant.Timestamp), timestamp)
+	}
+
+	return nil
+}
+
+// Delete implements MiitingStore.
+func (store *memoryStore) Delete(miitingID string) error {
+	store.miitings.Delete(miitingID)
+	return nil
+}
+
+// List implements MiitingStore.
+func (store *memoryStore) List() []*miiting {
+	miitings := []*miiting{}
+	store.miitings.Range(func(key, value interface{}) bool {
+		miitings = append(miitings, value.(*miiting))
+		return true
+	})
+
+	return miitings
+}
+
+// miitingRecord is the persisted form of a miiting.
+type miitingRecord struct {
+	ID           string                       `json:"id"`
+	Title        string                       `json:"title,omitempty"`
+	Timestamp    int64                        `json:"timestamp"`
+	Created      int64                        `json:"created,omitempty"`
+	Capacity     int                          `json:"capacity"`
+	Deadline     int64                        `json:"deadline,omitempty"`
+	Lobby        bool                         `json:"lobby"`
+	RelayOnly    bool                         `json:"relay_only"`
+	Host         string                       `json:"host"`
+	Locked       bool                         `json:"locked"`
+	Revoked      []string                     `json:"revoked,omitempty"`
+	Kicked       []string                     `json:"kicked,omitempty"`
+	PasscodeSalt []byte                       `json:"passcode_salt,omitempty"`
+	PasscodeHash []byte                       `json:"passcode_hash,omitempty"`
+	Participants map[string]participantRecord `json:"participants"`
+}
+
+// participantRecord is the persisted form of a participant, keyed by token in
+// its miiting record.
+type participantRecord struct {
+	ID            string `json:"id"`
+	Name          string `json:"name,omitempty"`
+	Role          string `json:"role"`
+	JoinTimestamp int64  `json:"join_timestamp"`
+	Timestamp     int64  `json:"timestamp"`
+	ResumeToken   string `json:"resume_token"`
+	ClientIP      string `json:"client_ip,omitempty"`
+}
+
+// recordMiiting returns the persisted form of the miiting. The miiting mutex
+// must be held by the caller.
+func recordMiiting(miiting *miiting) *miitingRecord {
+	record := &miitingRecord{
+		ID:           miiting.ID,
+		Title:        miiting.Title,
+		Timestamp:    atomic.LoadInt64(&(miiting.Timestamp)),
+		Created:      miiting.Created,
+		Capacity:     miiting.Capacity,
+		Deadline:     atomic.LoadInt64(&(miiting.Deadline)),
+		Lobby:        miiting.Lobby,
+		RelayOnly:    miiting.RelayOnly,
+		Host:         miiting.Host,
+		Locked:       miiting.Locked,
+		PasscodeSalt: miiting.passcodeSalt,
+		PasscodeHash: miiting.passcodeHash,
+		Participants: map[string]participantRecord{},
+	}
+	miiting.revoked.Range(func(token, value interface{}) bool {
+		record.Revoked = append(record.Revoked, token.(string))
+		return true
+	})
+	miiting.kicked.Range(func(address, value interface{}) bool {
+		record.Kicked = append(record.Kicked, address.(string))
+		return true
+	})
+	miiting.Tokens.Range(func(token, value interface{}) bool {
+		record.Participants[token.(string)] =
+			recordParticipant(value.(*participant))
+		return true
+	})
+
+	return record
+}
+
+// recordParticipant returns the persisted form of the participant.
+func recordParticipant(participant *participant) participantRecord {
+	return participantRecord{
+		ID:            participant.ID,
+		Name:          participant.Name,
+		Role:          participant.Role,
+		JoinTimestamp: participant.JoinTimestamp,
+		Timestamp:     atomic.LoadInt64(&(participant.Timestamp)),
+		ResumeToken:   participant.resumeToken,
+		ClientIP:      participant.clientIP,
+	}
+}
+
+// restoreMiiting recreates a live miiting from its persisted record.
+func restoreMiiting(record *miitingRecord) *miiting {
+	miiting := newMiiting(record.ID, record.Capacity, record.Timestamp)
+	miiting.Title = record.Title
+	if record.Created > 0 {
+		miiting.Created = record.Created
+	}
+	miiting.Deadline = record.Deadline
+	miiting.Lobby, miiting.Host = record.Lobby, record.Host
+	miiting.RelayOnly = record.RelayOnly
+	miiting.Locked = record.Locked
+	for _, token := range record.Revoked {
+		miiting.revoked.Store(token, true)
+	}
+	for _, address := range record.Kicked {
+		miiting.kicked.Store(address, true)
+	}
+	miiting.passcodeSalt = record.PasscodeSalt
+	miiting.passcodeHash = record.PasscodeHash
+	for token, participantRecord := range record.Participants {
+		miiting.Tokens.Store(token,
+			restoreParticipant(miiting, &participantRecord))
+	}
+
+	return miiting
+}
+
+// restoreParticipant recreates a participant of the miiting from its
+// persisted record.
+func restoreParticipant(miiting *miiting,
+	record *participantRecord) *participant {
+	participant := newParticipant(miiting, record.JoinTimestamp)
+	participant.ID = record.ID
+	participant.Name = record.Name
+	participant.Role = record.Role
+	participant.Timestamp = record.Timestamp
+	participant.resumeToken = record.ResumeToken
+	participant.clientIP = record.ClientIP
+
+	return participant
+}
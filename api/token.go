@@ -0,0 +1,187 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/jswirl/miit/api/middleware"
+	"github.com/jswirl/miit/config"
+)
+
+// tokenClaims are what a participant token is bound to. Tokens are signed by
+// the server, so clients can't forge them nor bind them to anything else.
+type tokenClaims struct {
+	KeyID         string `json:"kid"`
+	MiitingID     string `json:"mid"`
+	ParticipantID string `json:"pid"`
+	Expiry        int64  `json:"exp"`
+}
+
+// The scheme of Authorization headers carrying tokens.
+const bearerScheme = "Bearer"
+
+// The WebSocket subprotocol preceding the token in the subprotocols offered by
+// clients, since browsers can't set headers on WebSocket requests.
+const bearerSubprotocol = "bearer"
+
+// signingKey is a key signing participant tokens.
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// Token verification errors.
+var errTokenMissing = errors.New("missing token")
+var errTokenMalformed = errors.New("malformed token")
+var errTokenSignature = errors.New("invalid token signature")
+var errTokenExpired = errors.New("expired token")
+var errTokenMiiting = errors.New("token issued for another miiting")
+var errTokenNotOwner = errors.New("token not issued to the owner")
+
+// Token configurations. The first signing key signs new tokens, the others
+// only verify tokens signed before the keys were rotated.
+var signingKeys []signingKey
+var tokenTTL time.Duration
+var tokenQueryFallback bool
+
+func init() {
+	// Load configuration values.
+	tokenTTL = config.GetMilliseconds("MIIT_TOKEN_TTL")
+	tokenQueryFallback = config.GetBool("MIIT_TOKEN_QUERY_FALLBACK")
+	var err error
+	signingKeys, err = parseSigningKeys(config.GetString("MIIT_TOKEN_KEYS"))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// extractToken returns the token presented with the request, from its bearer
+// Authorization header or the subprotocols offered by a WebSocket client. The
+// token query parameter is only accepted as a deprecated fallback, if enabled.
+func extractToken(ctx *gin.Context) string {
+	// Take the token from the Authorization header.
+	if token := bearerCredentials(ctx); len(token) > 0 {
+		return token
+	}
+
+	// Take the token offered after the bearer subprotocol.
+	protocols := websocket.Subprotocols(ctx.Request)
+	if len(protocols) == 2 && protocols[0] == bearerSubprotocol {
+		return protocols[1]
+	}
+
+	// Fall back to the query parameter.
+	token := ctx.Query("token")
+	if len(token) > 0 && tokenQueryFallback {
+		middleware.GetLogger(ctx).Warn("Token passed in deprecated query")
+		return token
+	}
+
+	return ""
+}
+
+// bearerCredentials returns the credentials in the bearer Authorization header
+// of the request, if any.
+func bearerCredentials(ctx *gin.Context) string {
+	fields := strings.Fields(ctx.GetHeader("Authorization"))
+	if len(fields) == 2 && strings.EqualFold(fields[0], bearerScheme) {
+		return fields[1]
+	}
+
+	return ""
+}
+
+// parseSigningKeys parses a comma separated list of signing keys, each given
+// as its ID and secret separated by a colon.
+func parseSigningKeys(value string) ([]signingKey, error) {
+	keys := []signingKey{}
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(fields) != 2 || len(fields[0]) <= 0 || len(fields[1]) <= 0 {
+			return nil, fmt.Errorf("invalid token signing key: [%s]", entry)
+		}
+		keys = append(keys,
+			signingKey{id: fields[0], secret: []byte(fields[1])})
+	}
+
+	return keys, nil
+}
+
+// mintToken issues a token for the participant of the miiting, valid until
+// the expiry.
+func mintToken(miitingID string, participantID string,
+	expiry time.Time) string {
+	key := signingKeys[0]
+	claims, _ := json.Marshal(&tokenClaims{
+		KeyID:         key.id,
+		MiitingID:     miitingID,
+		ParticipantID: participantID,
+		Expiry:        expiry.Unix(),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(
+		signToken(key, payload))
+}
+
+// verifyToken verifies the signature and expiry of the token, and that it was
+// issued for the miiting, returning the claims it's bound to.
+func verifyToken(token string, miitingID string) (*tokenClaims, error) {
+	// Split the token into its payload and signature.
+	if len(token) <= 0 {
+		return nil, errTokenMissing
+	}
+	fields := strings.Split(token, ".")
+	if len(fields) != 2 {
+		return nil, errTokenMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	content, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	claims := &tokenClaims{}
+	if err := json.Unmarshal(content, claims); err != nil {
+		return nil, errTokenMalformed
+	}
+
+	// Check the signature against the key which signed the token.
+	valid := false
+	for _, key := range signingKeys {
+		if key.id == claims.KeyID {
+			valid = hmac.Equal(signToken(key, fields[0]), signature)
+			break
+		}
+	}
+	if !valid {
+		return nil, errTokenSignature
+	}
+
+	// Check what the token is bound to.
+	if time.Now().Unix() >= claims.Expiry {
+		return nil, errTokenExpired
+	} else if claims.MiitingID != miitingID {
+		return nil, errTokenMiiting
+	}
+
+	return claims, nil
+}
+
+// signToken returns the signature of the token payload with the key.
+func signToken(key signingKey, payload string) []byte {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseSigningKeys checks signing keys are parsed in order, and invalid
+// ones rejected.
+func TestParseSigningKeys(t *testing.T) {
+	keys, err := parseSigningKeys("new:first-secret, old:second:secret")
+	if err != nil || len(keys) != 2 || keys[0].id != "new" ||
+		string(keys[0].secret) != "first-secret" || keys[1].id != "old" ||
+		string(keys[1].secret) != "second:secret" {
+		t.Errorf("parseSigningKeys() = %v, %v", keys, err)
+	}
+
+	for _, value := range []string{"", "key", "key:", ":secret",
+		"key:secret,"} {
+		if _, err := parseSigningKeys(value); err == nil {
+			t.Errorf("parseSigningKeys(%q) error = nil", value)
+		}
+	}
+}
+
+// TestVerifyToken checks tokens are only valid until they expire, for the
+// miiting they were issued for, and if they were signed by a known key.
+func TestVerifyToken(t *testing.T) {
+	// Sign tokens with our own keys, the second of which was rotated out.
+	savedKeys := signingKeys
+	defer func() { signingKeys = savedKeys }()
+	signingKeys = []signingKey{{id: "current", secret: []byte("secret")}}
+	rotated := mintToken("m", "p", time.Now().Add(time.Hour))
+	signingKeys = []signingKey{{id: "next", secret: []byte("secret")},
+		{id: "current", secret: []byte("secret")}}
+	valid := mintToken("m", "p", time.Now().Add(time.Hour))
+	expired := mintToken("m", "p", time.Now().Add(-time.Second))
+
+	// Tamper with the claims of a valid token, keeping its signature.
+	fields := strings.Split(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"kid":"next","mid":"m","pid":"q","exp":9999999999}`)) +
+		"." + fields[1]
+	unknownKey := base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"kid":"gone","mid":"m","pid":"p","exp":9999999999}`)) +
+		"." + fields[1]
+
+	tests := []struct {
+		name      string
+		token     string
+		miitingID string
+		err       error
+	}{
+		{"valid", valid, "m", nil},
+		{"signed by rotated key", rotated, "m", nil},
+		{"missing", "", "m", errTokenMissing},
+		{"no signature", fields[0], "m", errTokenMalformed},
+		{"extra field", valid + ".x", "m", errTokenMalformed},
+		{"invalid encoding", "!." + fields[1], "m", errTokenMalformed},
+		{"invalid claims", base64.RawURLEncoding.EncodeToString(
+			[]byte("claims")) + "." + fields[1], "m", errTokenMalformed},
+		{"forged claims", forged, "m", errTokenSignature},
+		{"unknown key", unknownKey, "m", errTokenSignature},
+		{"truncated signature", valid[:len(valid)-4], "m",
+			errTokenSignature},
+		{"expired", expired, "m", errTokenExpired},
+		{"other miiting", valid, "n", errTokenMiiting},
+	}
+
+	for _, test := range tests {
+		claims, err := verifyToken(test.token, test.miitingID)
+		if err != test.err {
+			t.Errorf("%s: verifyToken() error = %v, want %v", test.name, err,
+				test.err)
+		} else if err == nil && (claims.MiitingID != "m" ||
+			claims.ParticipantID != "p") {
+			t.Errorf("%s: verifyToken() claims = %+v", test.name, claims)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/jswirl/miit/api/middleware"
+	"github.com/jswirl/miit/logging"
+)
+
+// Types of messages exchanged over miiting WebSockets. Miiting events other
+// than the availability of signals are relayed with their own event types.
+const (
+	messageTypeOffer           = "offer"
+	messageTypeAnswer          = "answer"
+	messageTypeCandidate       = "candidate"
+	messageTypeEndOfCandidates = "end_of_candidates"
+	messageTypeKeepAlive       = "keepalive"
+	messageTypeBye             = "bye"
+	messageTypeError           = "error"
+)
+
+// message is a typed signaling message sent over a miiting WebSocket. Peer is
+// the participant ID of the recipient of messages sent by the client, and of
+// the sender of messages sent to the client. Replace allows an offer / answer
+// to overwrite one its recipient hasn't received yet.
+type message struct {
+	Type    string      `json:"type"`
+	Peer    string      `json:"peer,omitempty"`
+	Round   int64       `json:"round,omitempty"`
+	Replace bool        `json:"replace,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// socket is the WebSocket connection of a miiting participant.
+type socket struct {
+	conn   *websocket.Conn
+	mutex  sync.Mutex
+	logger *logging.Logger
+}
+
+// upgrader upgrades signaling requests to WebSocket connections.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	Subprotocols:    []string{bearerSubprotocol},
+}
+
+// ConnectWebSocket is the handler for participants connecting to a miiting
+// over WebSocket. The socket carries offers, answers and ICE candidates in
+// both directions, and also serves as the participant's keep-alive.
+func ConnectWebSocket(ctx *gin.Context) {
+	// Extract parameters from request.
+	miiting, _, token, err := extractParameters(ctx, false)
+	if err != nil {
+		return
+	}
+	participant := getParticipant(miiting, token)
+	if participant == nil {
+		abortWithStatusAndMessage(ctx, http.StatusGone,
+			"Participant has left miiting [%s]", miiting.ID)
+		return
+	}
+
+	// Upgrade the request to a WebSocket connection.
+	logger := middleware.GetLogger(ctx)
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// The upgrader has already responded with an error status.
+		logger.Error("Failed to upgrade to WebSocket: %v", err)
+		ctx.Abort()
+		return
+	}
+	defer conn.Close()
+	socket := &socket{conn: conn, logger: logger}
+
+	// Refresh our timestamps whenever the client answers our pings.
+	refreshTimestamps(miiting, token)
+	conn.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+	conn.SetPongHandler(func(string) error {
+		refreshTimestamps(miiting, token)
+		return conn.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+	})
+
+	// Forward signals & events from our peers and keep pinging the client.
+	socketCtx, cancel := context.WithCancel(participant.ctx)
+	defer cancel()
+	go socket.forwardSignals(socketCtx, miiting, participant)
+	go socket.forwardEvents(socketCtx, miiting, participant)
+	go socket.ping(socketCtx)
+
+	// Process incoming messages until the client disconnects or says bye.
+	for socket.receive(miiting, participant, token) {
+	}
+}
+
+// receive reads and processes a message from the client, returning false
+// when the socket should be closed.
+func (socket *socket) receive(miiting *miiting, participant *participant,
+	token string) bool {
+	// Read the next message from the client.
+	msg := message{}
+	if err := socket.conn.ReadJSON(&msg); err != nil {
+		if websocket.IsUnexpectedCloseError(err,
+			websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			socket.logger.Warn("WebSocket closed unexpectedly: %v", err)
+		}
+		return false
+	}
+
+	// Any message from the client counts as a keep-alive.
+	refreshTimestamps(miiting, token)
+	socket.conn.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+
+	// Dispatch the message according to its type.
+	switch msg.Type {
+	case messageTypeOffer, messageTypeAnswer:
+		if msg.Payload == nil {
+			socket.sendError(msg, "Missing %s payload", msg.Type)
+			return true
+		}
+		link, err := getLink(miiting, participant, msg.Peer)
+		if err == nil {
+			_, err = submitDescription(miiting, link, msg.Round,
+				participant.ID, msg.Type, msg.Payload, msg.Replace)
+		}
+		if err == errMiitingEnded {
+			return false
+		} else if err != nil {
+			socket.sendError(msg, "Failed to submit %s: %v", msg.Type, err)
+		}
+		return true
+	case messageTypeCandidate, messageTypeEndOfCandidates:
+		// Accept both single candidates and batches of candidates.
+		candidates, isBatch := msg.Payload.([]interface{})
+		if !isBatch && msg.Payload != nil {
+			candidates = []interface{}{msg.Payload}
+		}
+
+		// Our candidates are of the type we sent this round.
+		link, err := getLink(miiting, participant, msg.Peer)
+		var negotiation *negotiation
+		if err == nil {
+			negotiation, err = getNegotiation(link, msg.Round)
+		}
+		if err == nil {
+			_, _, err = submitCandidates(miiting, link, negotiation.Round,
+				participant.ID, negotiation.localType(participant.ID),
+				candidates, msg.Type == messageTypeEndOfCandidates)
+		}
+		if err != nil {
+			socket.sendError(msg, "Failed to add ICE candidates: %v", err)
+		}
+		return true
+	case messageTypeKeepAlive:
+		socket.send(message{Type: messageTypeKeepAlive})
+		return true
+	case messageTypeBye:
+		// Leave the miiting, the others may carry on without us.
+		removeParticipant(miiting, token, leaveReasonLeft)
+		return false
+	}
+
+	socket.sendError(msg, "Invalid message type: [%s]", msg.Type)
+	return true
+}
+
+// forwardSignals relays the descriptions and ICE candidates submitted over
+// the links of the participant to the client, picking up new links as they
+// are established.
+func (socket *socket) forwardSignals(ctx context.Context, miiting *miiting,
+	participant *participant) {
+	// Forward the signals of each link until the socket is closed.
+	forwarded := map[*link]bool{}
+	for ctx.Err() == nil {
+		links, updated := getLinks(miiting, participant.ID)
+		for _, link := range links {
+			if !forwarded[link] {
+				forwarded[link] = true
+				go socket.forwardLink(ctx, link, participant.ID)
+			}
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+		}
+	}
+
+	// Say goodbye and hang up if we're no longer in the miiting.
+	if participant.ctx.Err() != nil {
+		socket.send(message{Type: messageTypeBye})
+		socket.conn.Close()
+	}
+}
+
+// forwardLink relays the signals of the negotiation rounds of a link to the
+// client until the link is closed or the context is done.
+func (socket *socket) forwardLink(ctx context.Context, link *link,
+	participantID string) {
+	for ctx.Err() == nil {
+		negotiation, err := getNegotiation(link, 0)
+		if err != nil {
+			return
+		}
+		socket.forwardNegotiation(ctx, link, negotiation, participantID)
+	}
+}
+
+// forwardNegotiation relays the signals of a single negotiation round to the
+// client, until the round is superseded or the context is done.
+func (socket *socket) forwardNegotiation(ctx context.Context, link *link,
+	negotiation *negotiation, participantID string) {
+	// We receive whatever our peer sends this round.
+	peerID := link.peer(participantID)
+	remoteType := negotiation.remoteType(participantID)
+	mailbox := negotiation.mailbox(remoteType)
+	queue := negotiation.candidateQueue(remoteType)
+
+	// Trickle candidates to the client as soon as they are queued.
+	cursor, completed := 0, false
+	for {
+		candidates, queueCompleted, queueUpdated := queue.after(cursor)
+		for _, candidate := range candidates {
+			socket.send(message{Type: messageTypeCandidate, Peer: peerID,
+				Round: negotiation.Round, Payload: candidate})
+		}
+		cursor += len(candidates)
+		if queueCompleted && !completed {
+			socket.send(message{Type: messageTypeEndOfCandidates,
+				Peer: peerID, Round: negotiation.Round})
+			completed, queueUpdated = true, nil
+		}
+
+		// Deliver the description once our peer leaves it in the mailbox.
+		sdp, occupied, mailboxUpdated := mailbox.take()
+		if occupied {
+			socket.send(message{Type: remoteType, Peer: peerID,
+				Round: negotiation.Round, Payload: sdp})
+		}
+
+		select {
+		case <-queueUpdated:
+		case <-mailboxUpdated:
+		case <-negotiation.superseded:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forwardEvents relays the events of the miiting to the client, except for
+// the availability of signals, which the socket forwards by itself.
+func (socket *socket) forwardEvents(ctx context.Context, miiting *miiting,
+	participant *participant) {
+	events := miiting.events.subscribe(participant.ID)
+	defer miiting.events.unsubscribe(events)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case eventTypeOfferAvailable, eventTypeAnswerAvailable,
+				eventTypeCandidatesAvailable:
+				continue
+			}
+			socket.send(message{Type: event.Type, Peer: event.From,
+				Payload: event.Data})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ping periodically pings the client until the context is done.
+func (socket *socket) ping(ctx context.Context) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(keepAliveInterval)
+			if err := socket.conn.WriteControl(websocket.PingMessage,
+				nil, deadline); err != nil {
+				socket.logger.Warn("Failed to ping WebSocket: %v", err)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send writes a message to the client.
+func (socket *socket) send(msg message) {
+	// Only one writer is allowed on the connection at a time.
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	socket.conn.SetWriteDeadline(time.Now().Add(keepAliveTimeout))
+	if err := socket.conn.WriteJSON(msg); err != nil {
+		socket.logger.Error("Failed to send [%s] message: %v", msg.Type, err)
+	}
+}
+
+// sendError writes an error message regarding a message of the client back to
+// the client.
+func (socket *socket) sendError(msg message, format string,
+	arguments ...interface{}) {
+	socket.logger.Error(format, arguments...)
+	payload := fmt.Sprintf(format, arguments...)
+	socket.send(message{Type: messageTypeError, Peer: msg.Peer,
+		Round: msg.Round, Payload: payload})
+}
@@ -13,26 +13,38 @@ var apiUrl = miitingsUrl + '/' + miitingID;
 var localName = 'anonymous';
 var remoteName = 'anonymous';
 
-/* The token used to create and join a miiting. */
-var token = generateToken();
+/* The token issued by the server when we ask to join a miiting. */
+var token = '';
+
+/* Session storage key of the token resuming our slot after page reloads. */
+var resumeTokenKey = 'miit-resume-token-' + miitingID;
+
+/* The settings below are defaults, overridden by the client configurations
+ * delivered by the server. */
 
 /* Keep-alive task handle and send interval in milliseconds */
-const KEEP_ALIVE_INTERVAL = 5000;
-const KEEP_ALIVE_ERROR_THRESHOLD_COUNT = 3;
+var KEEP_ALIVE_INTERVAL = 5000;
+var KEEP_ALIVE_ERROR_THRESHOLD_COUNT = 3;
 var keepAliveHandle;
 var keepAliveErrorCount = 0;
 
 /* Page reload timeout when disconnected. */
-const PAGE_RELOAD_TIMEOUT_MS = 15 * 1000;
+var PAGE_RELOAD_TIMEOUT_MS = 15 * 1000;
 
 /* Size of a block / chunk of a file */
-const CHUNK_SIZE = 4096;
-const BLOCK_SIZE = 1000 * CHUNK_SIZE;
-const CHUNKS_PER_BLOCK = BLOCK_SIZE / CHUNK_SIZE;
+var CHUNK_SIZE = 4096;
+var BLOCK_SIZE = 1000 * CHUNK_SIZE;
+var CHUNKS_PER_BLOCK = BLOCK_SIZE / CHUNK_SIZE;
 
 /* File datachannel buffer size & send backoff time */
-const FILECHANNEL_BUFFER_SIZE = 16 * 1024 * 1024;
-const FILECHANNEL_BACKOFF_MS = 1000;
+var FILECHANNEL_BUFFER_SIZE = 16 * 1024 * 1024;
+var FILECHANNEL_BACKOFF_MS = 1000;
+
+/* Features turned on or off by the server. */
+var features = {
+    'file_transfer': true,
+    'notification_sound': true,
+};
 
 /* File sequence number to track the number of files we've sent.*/
 var fileCount = 0;
@@ -40,6 +52,9 @@ var fileCount = 0;
 /* Our role in the miiting session. */
 var isInitiator = true;
 
+/* Flag indicating if we're waiting in the lobby for the host to let us in. */
+var isWaitingInLobby = false;
+
 /* Flag indicating if our browser is capable of media functions. */
 var isMediaCapable = false;
 
@@ -51,15 +66,15 @@ var MessageBarFile, MessageBarButton, ClearFileSelectionButton;
 var sendFileTransfers = {}, receiveFileTransfers = {}, quack;
 var localIceCandidates = [], pageReloadID;
 
+/* The UDP port of the STUN server built into miit. */
+const STUN_PORT = 3478;
+
 /* ICE Server Configurations */
 var peerConnectionConfig = {
     'iceServers': [
         {
             'urls': [
-                'stun:stun.l.google.com:19302',
-                'stun:stunserver.org',
-                // 'stun:stun.services.mozilla.com',
-                // 'stun:stun.xten.com',
+                'stun:' + window.location.hostname + ':' + STUN_PORT,
             ],
         },
     ],
@@ -245,9 +260,14 @@ function run() {
     };
 
     // Execute promise chain for miiting setup.
-    tryCreateMiiting().catch(abortOnError).
+    requestClientConfig().catch(errorHandler).
+        then(applyClientConfig, errorHandler).
+        then(tryCreateMiiting, abortOnError).
+        then(waitForAdmission, abortOnError).
         then(determineMiitingRole, abortOnError).
         then(beginKeepAlive, abortOnError).
+        then(requestIceServers, abortOnError).
+        then(setIceServers, errorHandler).
         then(createPeerConnection, abortOnError).
         then(setupDataChannels, abortOnError).
         then(continueBasedOnRole, abortOnError).
@@ -258,6 +278,46 @@ function run() {
         catch(showError, showError);
 }
 
+function requestClientConfig() {
+    return request('GET', apiUrl + '/config', null, true);
+}
+
+function applyClientConfig(xhr) {
+    // Keep the defaults if we didn't get any configurations.
+    if (!(xhr instanceof XMLHttpRequest)) {
+        return;
+    }
+
+    var json = JSON.parse(xhr.responseText);
+    if (json.ice_servers && json.ice_servers.length > 0) {
+        peerConnectionConfig.iceServers = json.ice_servers;
+    }
+    KEEP_ALIVE_INTERVAL = json.keepalive_interval || KEEP_ALIVE_INTERVAL;
+    KEEP_ALIVE_ERROR_THRESHOLD_COUNT = json.keepalive_error_threshold ||
+        KEEP_ALIVE_ERROR_THRESHOLD_COUNT;
+    PAGE_RELOAD_TIMEOUT_MS = json.page_reload_timeout || PAGE_RELOAD_TIMEOUT_MS;
+    CHUNK_SIZE = json.file_chunk_size || CHUNK_SIZE;
+    BLOCK_SIZE = (json.file_block_chunks || CHUNKS_PER_BLOCK) * CHUNK_SIZE;
+    CHUNKS_PER_BLOCK = BLOCK_SIZE / CHUNK_SIZE;
+    FILECHANNEL_BUFFER_SIZE = json.file_channel_buffer_size ||
+        FILECHANNEL_BUFFER_SIZE;
+    FILECHANNEL_BACKOFF_MS = json.file_channel_backoff ||
+        FILECHANNEL_BACKOFF_MS;
+    Object.assign(features, json.features || {});
+
+    // Hide what's been turned off.
+    if (!features.file_transfer) {
+        document.getElementById('MessageBarFileLabel').style.display = 'none';
+        MessageBarFile.disabled = true;
+    }
+}
+
+function playNotificationSound() {
+    if (features.notification_sound) {
+        quack.play();
+    }
+}
+
 function tryCreateMiiting() {
     console.log('Trying to create miiting...');
 
@@ -265,13 +325,57 @@ function tryCreateMiiting() {
     var miiting = {};
     miiting[miitingID] = {
         'token': token,
+        'resume_token': sessionStorage.getItem(resumeTokenKey) || '',
     };
 
     return request('POST', miitingsUrl, JSON.stringify(miiting), true);
 }
 
+function waitForAdmission(xhr) {
+    // We're in, unless we've been parked in the lobby.
+    if (xhr.status != 202) {
+        return xhr;
+    }
+
+    // Keep asking with the token we've been issued in the lobby.
+    var json = JSON.parse(xhr.responseText);
+    if (json.token) {
+        token = json.token;
+    }
+
+    // Keep asking to join until the host lets us in.
+    if (!isWaitingInLobby) {
+        isWaitingInLobby = true;
+        addMessage(null, makeMessageTextDiv(
+            'Waiting for the host to let you in...'));
+    }
+    return new Promise(resolve => setTimeout(resolve, KEEP_ALIVE_INTERVAL)).
+        then(tryCreateMiiting).then(waitForAdmission);
+}
+
 function determineMiitingRole(xhr) {
-    // Determine our role based on received status code.
+    // Keep the token we've been issued, and our resume token in case we need
+    // to reload the page.
+    var json = JSON.parse(xhr.responseText);
+    if (json.token) {
+        token = json.token;
+    }
+    if (json.resume_token) {
+        sessionStorage.setItem(resumeTokenKey, json.resume_token);
+    }
+
+    // Only gather relay candidates if we mustn't reveal our addresses.
+    if (json.relay_only) {
+        peerConnectionConfig.iceTransportPolicy = 'relay';
+    }
+
+    // Determine our role from the participant record assigned by the server.
+    if (json.participant && json.participant.role) {
+        isInitiator = json.participant.role == 'offerer';
+        return isInitiator;
+    }
+
+    // Fall back to the received status code.
     if (xhr.status == 201) {
         isInitiator = true;
         return true;
@@ -288,7 +392,7 @@ function beginKeepAlive() {
 }
 
 function sendKeepAliveRequest() {
-    request('PATCH', apiUrl + '?token=' + token, '{}', true).
+    request('PATCH', apiUrl, '{}', true).
         then(handleKeepAliveResponse).catch(handleKeepAliveError);
 }
 
@@ -306,6 +410,19 @@ function handleKeepAliveError(error) {
     }
 }
 
+function requestIceServers() {
+    return request('GET', apiUrl + '/ice_servers', null, true);
+}
+
+function setIceServers(xhr) {
+    // Connect through the ICE servers we've been given, with their short-lived
+    // TURN credentials, or keep the default ones.
+    var json = JSON.parse(xhr.responseText);
+    if (json.ice_servers && json.ice_servers.length > 0) {
+        peerConnectionConfig.iceServers = json.ice_servers;
+    }
+}
+
 function createPeerConnection() {
     console.log('Creating RTCPeerConnection...');
 
@@ -464,8 +581,7 @@ function sendLocalDescription() {
         'description': rtcPeerConnection.localDescription.sdp,
     };
 
-    return request('POST', apiUrl + '?token=' + token,
-        JSON.stringify(sdp), true);
+    return request('POST', apiUrl, JSON.stringify(sdp), true);
 }
 
 function requestRemoteDescription() {
@@ -475,8 +591,7 @@ function requestRemoteDescription() {
     addMessage(null, makeMessageTextDiv(
         'Waiting for peer to join...'));
 
-    return request('GET', apiUrl + '/' + remoteSDPType() + '?token=' + token,
-        null, true);
+    return request('GET', apiUrl + '/' + remoteSDPType(), null, true);
 }
 
 function receiveRemoteDescription(xhr) {
@@ -493,7 +608,7 @@ function receiveRemoteDescription(xhr) {
     remoteName = json.name;
     addMessage(null, makeMessageTextDiv(remoteName + ' joined.'));
     addMessage(null, makeMessageTextDiv('Connecting with ' + remoteName + '...'));
-    quack.play();
+    playNotificationSound();
 
     return new RTCSessionDescription(jsep);
 }
@@ -517,14 +632,13 @@ function sendLocalIceCandidates() {
         'ice_candidates': localIceCandidates,
     });
 
-    return request('POST', apiUrl + '/' + localSDPType() + '?token=' + token,
-        json, true);
+    return request('POST', apiUrl + '/' + localSDPType(), json, true);
 }
 
 function requestRemoteIceCandidates() {
     console.log('Requesting remote ICE candidates...');
     return request('GET', apiUrl + '/' + remoteSDPType() +
-        '/ice_candidates?token=' + token, null, true);
+        '/ice_candidates', null, true);
 }
 
 function receiveRemoteIceCandidates(xhr) {
@@ -618,7 +732,7 @@ function handleMessageChannelJSON(event) {
         addMessage(remoteName, makeMessageTextDiv(json.payload));
     } else if (json.type == 'fileinfo') {
         addMessage(null, makeFileTransferPromptDiv(json.payload));
-        quack.play();
+        playNotificationSound();
     } else if (json.type == 'filetransfer') {
         var response = json.payload;
         if (response.accepted) {
@@ -700,7 +814,7 @@ function teardown() {
         pageReloadID = pageReloadID || setTimeout(function() {
             window.location.reload(true)}, PAGE_RELOAD_TIMEOUT_MS);
         showPageReloadMessage();
-        quack.play();
+        playNotificationSound();
         finalize();
     }
 }
@@ -728,7 +842,7 @@ function showPageReloadMessage() {
 
 function deleteMiiting() {
     // Delete the miiting on best effor basis.
-    request('DELETE', apiUrl + '?token=' + token, null, true).
+    request('DELETE', apiUrl, null, true).
         then(errorHandler, errorHandler);
 }
 
@@ -738,6 +852,9 @@ function request(method, url, body, async) {
         var xhr = new XMLHttpRequest();
         xhr.open(method, url, async);
         xhr.setRequestHeader('Content-type', 'application/json');
+        if (token) {
+            xhr.setRequestHeader('Authorization', 'Bearer ' + token);
+        }
 
         // Setup response handler.
         xhr.onload = function() {
@@ -803,15 +920,6 @@ function addMessage(name, element) {
     Messages.scrollTop = Messages.scrollHeight;
 }
 
-function generateToken() {
-    var token = '';
-    var runes = 'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789';
-    for (var i = 0; i < 16; i++) {
-        token += runes.charAt(Math.floor(Math.random() * runes.length));
-    }
-    return token;
-}
-
 function getCookie(key) {
     var value = '; ' + document.cookie;
     var parts = value.split('; ' + key + '=');
@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/jswirl/miit/config"
 	"github.com/jswirl/miit/global"
 	"github.com/jswirl/miit/logging"
 	"github.com/jswirl/miit/server"
+	"github.com/jswirl/miit/stun"
 )
 
 func main() {
@@ -20,15 +22,40 @@ func main() {
 	address := fmt.Sprintf("%s:%s",
 		config.GetString("SERVER_LISTEN_ADDRESS"),
 		config.GetString("SERVER_LISTEN_PORT"))
-	server := server.CreateServer(global.Context, address)
+	httpServer := server.CreateServer(global.Context, address)
 
 	// Now that we finished initializing all necessary modules,
 	// let's turn on the readiness indication flag.
 	global.Ready = true
 
 	// Start servicing requests.
+	server.StartAdminServer()
+	server.StartTURNServer()
+	startSTUNServer()
 	logging.Info("Initialization complete, listening on %s...", address)
-	if err := server.ListenAndServe(); err != nil {
-		logging.Info(err.Error())
+	err := httpServer.ListenAndServe()
+	logging.Info(err.Error())
+
+	// Wait for graceful shutdown to complete before exiting.
+	if err == http.ErrServerClosed {
+		server.WaitForShutdown()
 	}
 }
+
+// startSTUNServer starts answering STUN binding requests on its own UDP port,
+// if configured, until the global context is done.
+func startSTUNServer() {
+	port := config.GetInt("MIIT_STUN_LISTEN_PORT")
+	if port <= 0 {
+		return
+	}
+
+	go func() {
+		address := fmt.Sprintf(":%d", port)
+		logging.Info("Serving STUN on %s...", address)
+		err := stun.ListenAndServe(global.Context, address)
+		if err != nil {
+			logging.Error("Failed to serve STUN: %s", err.Error())
+		}
+	}()
+}
@@ -2,53 +2,198 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/jswirl/miit/api"
 	"github.com/jswirl/miit/config"
 	"github.com/jswirl/miit/global"
 	"github.com/jswirl/miit/logging"
+	"github.com/jswirl/miit/stun"
 )
 
-// CreateServer creates an HTTP server listening on the specified address.
+// shutdownComplete is closed once graceful shutdown has completed.
+var shutdownComplete = make(chan struct{})
+
+// adminServer is the HTTP server serving the admin API on its own loopback
+// listener, if configured.
+var adminServer *http.Server
+
+// turnServer is the TURN server relaying the media of clients which can't
+// reach their peers directly, if enabled.
+var turnServer *stun.TURNServer
+
+// CreateServer creates an HTTP server listening on the specified address, the
+// admin server if the admin API has its own listener, and the TURN server if
+// it's enabled.
 func CreateServer(ctx context.Context, address string) *http.Server {
 	// Setup HTTP Server.
 	server := &http.Server{
 		Addr:    address,
 		Handler: api.GetRouter(),
 	}
+	servers := []*http.Server{server}
+
+	// Setup admin HTTP server.
+	if adminAddress := api.GetAdminAddress(); len(adminAddress) > 0 {
+		adminServer = &http.Server{
+			Addr:    adminAddress,
+			Handler: api.GetAdminRouter(),
+		}
+		servers = append(servers, adminServer)
+	}
+
+	// Setup TURN server.
+	if config.GetBool("MIIT_TURN_ENABLED") {
+		turnServer = createTURNServer()
+	}
 
 	// Install the shutdown handler.
-	installShutdownHandler(ctx, server)
+	installShutdownHandler(ctx, servers...)
 
 	return server
 }
 
-// installShutdownHandler registers a shutdown handler for graceful shutdown.
-func installShutdownHandler(ctx context.Context, server *http.Server) {
-	// Create signal channel & shutdown timeout context.
-	sigChan := make(chan os.Signal)
+// StartAdminServer starts serving the admin API on its own listener, if it
+// has one.
+func StartAdminServer() {
+	if adminServer == nil {
+		return
+	}
+
+	go func() {
+		logging.Info("Serving admin API on %s...", adminServer.Addr)
+		err := adminServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			logging.Error("Failed to serve admin API: %s", err.Error())
+		}
+	}()
+}
+
+// StartTURNServer starts relaying the media of clients, if the TURN server is
+// enabled.
+func StartTURNServer() {
+	if turnServer == nil {
+		return
+	}
+
+	go func() {
+		logging.Info("Serving TURN on %s...", turnServer.Addr())
+		err := turnServer.ListenAndServe()
+		if err != stun.ErrServerClosed {
+			logging.Error("Failed to serve TURN: %s", err.Error())
+		}
+	}()
+}
+
+// createTURNServer creates the TURN server from its configurations.
+func createTURNServer() *stun.TURNServer {
+	// Relayed transport addresses are given to peers, so they must be on a
+	// specific address.
+	relayAddress := net.ParseIP(config.GetString("MIIT_TURN_RELAY_ADDRESS"))
+	if relayAddress == nil || relayAddress.IsUnspecified() {
+		panic(fmt.Errorf("invalid TURN relay address: [%s]",
+			config.GetString("MIIT_TURN_RELAY_ADDRESS")))
+	}
+	address := fmt.Sprintf(":%d", config.GetInt("MIIT_TURN_LISTEN_PORT"))
+	credentials, err := parseTURNCredentials(
+		config.GetString("MIIT_TURN_CREDENTIALS"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Peers on local networks are denied unless they're explicitly allowed.
+	allowedPeers, err := stun.ParseNetworks(
+		config.GetString("MIIT_TURN_ALLOWED_PEERS"))
+	if err != nil {
+		panic(err)
+	}
+	deniedPeers, err := stun.ParseNetworks(
+		config.GetString("MIIT_TURN_DENIED_PEERS"))
+	if err != nil {
+		panic(err)
+	}
+
+	return stun.NewTURNServer(stun.TURNConfig{
+		Address:        address,
+		Realm:          config.GetString("MIIT_TURN_REALM"),
+		RelayAddress:   relayAddress,
+		RelayPortMin:   config.GetInt("MIIT_TURN_RELAY_PORT_MIN"),
+		RelayPortMax:   config.GetInt("MIIT_TURN_RELAY_PORT_MAX"),
+		MaxAllocations: config.GetInt("MIIT_TURN_MAX_ALLOCATIONS"),
+		Credentials:    credentials,
+		Secret:         config.GetString("MIIT_TURN_SECRET"),
+		AllowedPeers:   allowedPeers,
+		DeniedPeers:    deniedPeers,
+	})
+}
+
+// parseTURNCredentials parses a comma separated list of TURN credentials, each
+// given as its username and password separated by a colon.
+func parseTURNCredentials(value string) (map[string]string, error) {
+	credentials := map[string]string{}
+	if len(strings.TrimSpace(value)) <= 0 {
+		return credentials, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(fields) != 2 || len(fields[0]) <= 0 || len(fields[1]) <= 0 {
+			return nil, fmt.Errorf("invalid TURN credential: [%s]", fields[0])
+		}
+		credentials[fields[0]] = fields[1]
+	}
+
+	return credentials, nil
+}
+
+// installShutdownHandler registers a shutdown handler for graceful shutdown of
+// the servers.
+func installShutdownHandler(ctx context.Context, servers ...*http.Server) {
+	// Create signal channel.
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	timeoutCtx, cancel := context.WithTimeout(ctx,
-		config.GetMilliseconds("SERVER_SHUTDOWN_GRACE_PERIOD_MS"))
+	gracePeriod := config.GetMilliseconds("SERVER_SHUTDOWN_GRACE_PERIOD_MS")
 
 	// Catch signals in a separate goroutine.
 	go func() {
-		defer cancel()
+		defer close(shutdownComplete)
 
 		// Wait for signals.
 		sig := <-sigChan
 		signal.Stop(sigChan)
 		logging.Warn("Received signal: %s.", sig.String())
 
-		// Perform graceful shutdown.
+		// Perform graceful shutdown, the grace period starts now so handlers
+		// are drained before the snapshot is saved.
+		timeoutCtx, cancel := context.WithTimeout(ctx, gracePeriod)
+		defer cancel()
 		logging.Warn("Initiating graceful shutdown...")
 		global.Alive = false
-		if err := server.Shutdown(timeoutCtx); err != nil {
-			logging.Error("Failed to shutdown: %s", err.Error())
+		for _, server := range servers {
+			if err := server.Shutdown(timeoutCtx); err != nil {
+				logging.Error("Failed to shutdown: %s", err.Error())
+			}
+		}
+
+		// Release all TURN allocations.
+		if turnServer != nil {
+			turnServer.Shutdown()
+		}
+
+		// Save live miitings for the next instance to resume.
+		if err := api.SaveSnapshot(); err != nil {
+			logging.Error("Failed to save snapshot: %s", err.Error())
 		}
 	}()
 }
+
+// WaitForShutdown blocks until graceful shutdown has completed.
+func WaitForShutdown() {
+	<-shutdownComplete
+}
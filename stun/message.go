@@ -0,0 +1,316 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+// STUN message header constants, see RFC 5389.
+const (
+	headerSize     = 20
+	magicCookie    = 0x2112A442
+	fingerprintXOR = 0x5354554e
+)
+
+// STUN message classes, already shifted into place within message types.
+const (
+	classRequest    = 0x0000
+	classIndication = 0x0010
+	classSuccess    = 0x0100
+	classError      = 0x0110
+)
+
+// STUN methods, and the TURN methods of RFC 5766.
+const (
+	methodBinding          = 0x001
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+	methodChannelBind      = 0x009
+)
+
+// STUN attribute types. Types below 0x8000 are comprehension-required.
+const (
+	attrMappedAddress      = 0x0001
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrUnknownAttributes  = 0x000A
+	attrChannelNumber      = 0x000C
+	attrLifetime           = 0x000D
+	attrXORPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXORRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+	attrXORMappedAddress   = 0x0020
+	attrSoftware           = 0x8022
+	attrFingerprint        = 0x8028
+)
+
+// STUN address families.
+const (
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+// Message parsing errors.
+var errMessageTruncated = errors.New("truncated message")
+var errMessageNotSTUN = errors.New("not a STUN message")
+var errMessageFingerprint = errors.New("invalid fingerprint")
+var errMessageIntegrity = errors.New("invalid message integrity")
+var errAddressFamily = errors.New("invalid address family")
+
+// message is a STUN message. Decoded messages keep the datagram they were
+// decoded from to check their integrity, encoded messages are signed with the
+// integrity key if they have one.
+type message struct {
+	method          uint16
+	class           uint16
+	transactionID   [12]byte
+	attributes      []attribute
+	raw             []byte
+	integrityOffset int
+	integrityKey    []byte
+}
+
+// attribute is a STUN attribute of a message.
+type attribute struct {
+	kind  uint16
+	value []byte
+}
+
+// parseMessage decodes the STUN message in the datagram, checking its header
+// and fingerprint.
+func parseMessage(data []byte) (*message, error) {
+	// Check the header, the first two bits of STUN messages are zeroes.
+	if len(data) < headerSize {
+		return nil, errMessageTruncated
+	} else if data[0]&0xC0 != 0 ||
+		binary.BigEndian.Uint32(data[4:8]) != magicCookie {
+		return nil, errMessageNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || headerSize+length != len(data) {
+		return nil, errMessageTruncated
+	}
+
+	// Decode the message type into its method & class.
+	kind := binary.BigEndian.Uint16(data[0:2])
+	msg := &message{
+		method:          kind&0x000F | (kind>>1)&0x0070 | (kind>>2)&0x0F80,
+		class:           kind & 0x0110,
+		raw:             data,
+		integrityOffset: -1,
+	}
+	copy(msg.transactionID[:], data[8:headerSize])
+
+	// Decode the attributes, each padded to a multiple of 4 bytes.
+	for offset := headerSize; offset < len(data); {
+		if offset+4 > len(data) {
+			return nil, errMessageTruncated
+		}
+		attrKind := binary.BigEndian.Uint16(data[offset : offset+2])
+		attrLength := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		end := offset + 4 + attrLength
+		if end > len(data) {
+			return nil, errMessageTruncated
+		}
+
+		// The fingerprint must be the last attribute and match the message.
+		if attrKind == attrFingerprint {
+			if attrLength != 4 || end != len(data) ||
+				binary.BigEndian.Uint32(data[offset+4:end]) !=
+					fingerprint(data[:offset]) {
+				return nil, errMessageFingerprint
+			}
+		}
+
+		// Attributes following the message integrity are ignored, except for
+		// the fingerprint.
+		if attrKind == attrMessageIntegrity && msg.integrityOffset < 0 {
+			if attrLength != sha1.Size {
+				return nil, errMessageIntegrity
+			}
+			msg.integrityOffset = offset
+		} else if msg.integrityOffset >= 0 {
+			offset = end + (4-attrLength%4)%4
+			continue
+		}
+
+		msg.attributes = append(msg.attributes,
+			attribute{attrKind, data[offset+4 : end]})
+		offset = end + (4-attrLength%4)%4
+	}
+
+	return msg, nil
+}
+
+// newResponse creates a response of the class to the request.
+func newResponse(request *message, class uint16) *message {
+	return &message{
+		method:        request.method,
+		class:         class,
+		transactionID: request.transactionID,
+	}
+}
+
+// add appends an attribute to the message.
+func (msg *message) add(kind uint16, value []byte) {
+	msg.attributes = append(msg.attributes, attribute{kind, value})
+}
+
+// get returns the value of the first attribute of the type in the message.
+func (msg *message) get(kind uint16) ([]byte, bool) {
+	for _, attr := range msg.attributes {
+		if attr.kind == kind {
+			return attr.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// checkIntegrity checks the message integrity of the decoded message against
+// the key.
+func (msg *message) checkIntegrity(key []byte) bool {
+	if msg.integrityOffset < 0 {
+		return false
+	}
+
+	// The integrity covers the message up to its attribute, with the length
+	// in the header as if the attribute was the last one.
+	data := make([]byte, msg.integrityOffset)
+	copy(data, msg.raw[:msg.integrityOffset])
+	binary.BigEndian.PutUint16(data[2:4],
+		uint16(msg.integrityOffset-headerSize+4+sha1.Size))
+	value := msg.raw[msg.integrityOffset+4 : msg.integrityOffset+4+sha1.Size]
+
+	return hmac.Equal(integrity(key, data), value)
+}
+
+// encode encodes the message into a datagram, followed by its message
+// integrity if it has an integrity key, and its fingerprint.
+func (msg *message) encode() []byte {
+	// Encode the header with the message type & transaction ID.
+	data := make([]byte, headerSize, 512)
+	method := msg.method
+	kind := method&0x000F | (method&0x0070)<<1 | (method&0x0F80)<<2 |
+		msg.class
+	binary.BigEndian.PutUint16(data[0:2], kind)
+	binary.BigEndian.PutUint32(data[4:8], magicCookie)
+	copy(data[8:headerSize], msg.transactionID[:])
+
+	// Encode the attributes, padding each to a multiple of 4 bytes.
+	for _, attr := range msg.attributes {
+		data = appendAttribute(data, attr.kind, attr.value)
+	}
+
+	// Sign the message, its length already including the message integrity.
+	if msg.integrityKey != nil {
+		binary.BigEndian.PutUint16(data[2:4],
+			uint16(len(data)-headerSize+4+sha1.Size))
+		data = appendAttribute(data, attrMessageIntegrity,
+			integrity(msg.integrityKey, data))
+	}
+
+	// Fingerprint the message, its length already including the fingerprint.
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-headerSize+8))
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, fingerprint(data))
+
+	return appendAttribute(data, attrFingerprint, value)
+}
+
+// appendAttribute appends the padded attribute to the encoded message.
+func appendAttribute(data []byte, kind uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[0:2], kind)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+	data = append(append(data, header...), value...)
+
+	return append(data, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// fingerprint returns the fingerprint of the encoded message.
+func fingerprint(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data) ^ fingerprintXOR
+}
+
+// integrity returns the message integrity of the encoded message.
+func integrity(key []byte, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// longTermKey returns the key of long-term credentials, signing the messages
+// of the user within the realm.
+func longTermKey(username string, realm string, password string) []byte {
+	key := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return key[:]
+}
+
+// encodeXORAddress encodes the address XOR'ed with the magic cookie and the
+// transaction ID, as in XOR-MAPPED-ADDRESS attributes.
+func encodeXORAddress(addr *net.UDPAddr, transactionID [12]byte) []byte {
+	// Use the magic cookie followed by the transaction ID as the mask.
+	mask := make([]byte, 16)
+	binary.BigEndian.PutUint32(mask[0:4], magicCookie)
+	copy(mask[4:], transactionID[:])
+
+	// Encode the family, port and IP address.
+	ip, family := addr.IP.To4(), byte(familyIPv4)
+	if ip == nil {
+		ip, family = addr.IP.To16(), familyIPv6
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^magicCookie>>16)
+	for idx := range ip {
+		value[4+idx] = ip[idx] ^ mask[idx]
+	}
+
+	return value
+}
+
+// decodeXORAddress decodes an address XOR'ed with the magic cookie and the
+// transaction ID, as in XOR-PEER-ADDRESS attributes.
+func decodeXORAddress(value []byte, transactionID [12]byte) (*net.UDPAddr,
+	error) {
+	// Check the family and the length of the address.
+	if len(value) < 4 || !(value[1] == familyIPv4 && len(value) == 8 ||
+		value[1] == familyIPv6 && len(value) == 20) {
+		return nil, errAddressFamily
+	}
+
+	// Reverse the encoding with the same mask.
+	mask := make([]byte, 16)
+	binary.BigEndian.PutUint32(mask[0:4], magicCookie)
+	copy(mask[4:], transactionID[:])
+	ip := make(net.IP, len(value)-4)
+	for idx := range ip {
+		ip[idx] = value[4+idx] ^ mask[idx]
+	}
+	port := binary.BigEndian.Uint16(value[2:4]) ^ magicCookie>>16
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// encodeErrorCode encodes the error code and its reason phrase, as in
+// ERROR-CODE attributes.
+func encodeErrorCode(code int, reason string) []byte {
+	value := make([]byte, 4, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+
+	return append(value, reason...)
+}
@@ -0,0 +1,232 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// sampleRequest is the sample request of RFC 5769, section 2.1, signed with
+// the short-term password samplePassword.
+const sampleRequest = "000100582112a442b7e7a701bc34d686fa87dfae" +
+	"802200105354554e207465737420636c69656e74" +
+	"002400046e0001ff" +
+	"80290008932ff9b151263b36" +
+	"000600096576746a3a68367659202020" +
+	"000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a2" +
+	"80280004e57a3bcf"
+const samplePassword = "VOkJxbRl1RmTxUk/WvJxBt"
+
+// decodeHex decodes the hex string, failing the test if it's invalid.
+func decodeHex(t *testing.T, value string) []byte {
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatalf("Failed to decode [%s]: %v", value, err)
+	}
+
+	return data
+}
+
+// TestParseSampleRequest checks the sample request of RFC 5769 is decoded
+// with its attributes, fingerprint and message integrity.
+func TestParseSampleRequest(t *testing.T) {
+	msg, err := parseMessage(decodeHex(t, sampleRequest))
+	if err != nil {
+		t.Fatalf("parseMessage() error = %v", err)
+	}
+	if msg.method != methodBinding || msg.class != classRequest {
+		t.Errorf("parseMessage() method, class = %#x, %#x, want %#x, %#x",
+			msg.method, msg.class, methodBinding, classRequest)
+	}
+	if software, _ := msg.get(attrSoftware); string(software) !=
+		"STUN test client" {
+		t.Errorf("SOFTWARE = %q, want %q", software, "STUN test client")
+	}
+	if username, _ := msg.get(attrUsername); string(username) !=
+		"evtj:h6vY" {
+		t.Errorf("USERNAME = %q, want %q", username, "evtj:h6vY")
+	}
+	if !msg.checkIntegrity([]byte(samplePassword)) {
+		t.Errorf("checkIntegrity() = false with the sample password")
+	}
+	if msg.checkIntegrity([]byte("wrong password")) {
+		t.Errorf("checkIntegrity() = true with a wrong password")
+	}
+}
+
+// TestEncodeParse checks encoded messages decode back to the same message,
+// with or without message integrity.
+func TestEncodeParse(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       uint16
+		class        uint16
+		attributes   []attribute
+		integrityKey []byte
+	}{
+		{"empty request", methodBinding, classRequest, nil, nil},
+		{"padded attributes", methodAllocate, classError, []attribute{
+			{attrErrorCode, encodeErrorCode(401, "Unauthorized")},
+			{attrRealm, []byte("miit")},
+			{attrNonce, []byte("nonce")},
+		}, nil},
+		{"signed response", methodRefresh, classSuccess, []attribute{
+			{attrLifetime, []byte{0, 0, 2, 0x58}},
+			{attrSoftware, []byte("miit")},
+		}, longTermKey("user", "miit", "password")},
+		{"indication", methodData, classIndication, []attribute{
+			{attrData, []byte{1, 2, 3}},
+		}, nil},
+	}
+
+	for _, test := range tests {
+		msg := &message{method: test.method, class: test.class,
+			transactionID: [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			attributes:    test.attributes, integrityKey: test.integrityKey}
+		decoded, err := parseMessage(msg.encode())
+		if err != nil {
+			t.Errorf("%s: parseMessage() error = %v", test.name, err)
+			continue
+		}
+		if decoded.method != test.method || decoded.class != test.class ||
+			decoded.transactionID != msg.transactionID {
+			t.Errorf("%s: parseMessage() header = %#x, %#x, %x", test.name,
+				decoded.method, decoded.class, decoded.transactionID)
+		}
+
+		// The message integrity or else the fingerprint is decoded last, as
+		// attributes following the message integrity are ignored.
+		if test.integrityKey != nil &&
+			!decoded.checkIntegrity(test.integrityKey) {
+			t.Errorf("%s: checkIntegrity() = false", test.name)
+		}
+		attributes := decoded.attributes[:len(decoded.attributes)-1]
+		if len(attributes) != len(test.attributes) {
+			t.Errorf("%s: parseMessage() attributes = %d, want %d",
+				test.name, len(attributes), len(test.attributes))
+			continue
+		}
+		for idx, attr := range attributes {
+			if attr.kind != test.attributes[idx].kind ||
+				!bytes.Equal(attr.value, test.attributes[idx].value) {
+				t.Errorf("%s: attribute %d = %#x %x, want %#x %x", test.name,
+					idx, attr.kind, attr.value, test.attributes[idx].kind,
+					test.attributes[idx].value)
+			}
+		}
+	}
+}
+
+// TestParseMalformed checks malformed messages are rejected.
+func TestParseMalformed(t *testing.T) {
+	// Corrupt copies of a valid message with an attribute.
+	valid := (&message{method: methodBinding, class: classRequest,
+		attributes: []attribute{{attrSoftware, []byte("miit")}}}).encode()
+	corrupt := func(modify func(data []byte) []byte) []byte {
+		return modify(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short header", valid[:headerSize-1], errMessageTruncated},
+		{"not STUN", corrupt(func(data []byte) []byte {
+			data[0] |= 0x80
+			return data
+		}), errMessageNotSTUN},
+		{"wrong magic cookie", corrupt(func(data []byte) []byte {
+			data[4] ^= 0xFF
+			return data
+		}), errMessageNotSTUN},
+		{"unaligned length", corrupt(func(data []byte) []byte {
+			data = append(data, 0)
+			binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-headerSize))
+			return data
+		}), errMessageTruncated},
+		{"length beyond datagram", corrupt(func(data []byte) []byte {
+			return data[:len(data)-4]
+		}), errMessageTruncated},
+		{"attribute beyond message", corrupt(func(data []byte) []byte {
+			binary.BigEndian.PutUint16(data[headerSize+2:headerSize+4], 64)
+			return data
+		}), errMessageTruncated},
+		{"wrong fingerprint", corrupt(func(data []byte) []byte {
+			data[len(data)-1] ^= 0xFF
+			return data
+		}), errMessageFingerprint},
+		{"modified after fingerprint", corrupt(func(data []byte) []byte {
+			data[headerSize+4] ^= 0xFF
+			return data
+		}), errMessageFingerprint},
+		{"short message integrity", corrupt(func(data []byte) []byte {
+			data = appendAttribute(data[:headerSize], attrMessageIntegrity,
+				make([]byte, 8))
+			binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-headerSize))
+			return data
+		}), errMessageIntegrity},
+	}
+
+	for _, test := range tests {
+		if _, err := parseMessage(test.data); err != test.err {
+			t.Errorf("%s: parseMessage() error = %v, want %v", test.name, err,
+				test.err)
+		}
+	}
+}
+
+// TestXORAddress checks the XOR-MAPPED-ADDRESS samples of RFC 5769, section
+// 2.2 and 2.3, are encoded and decoded.
+func TestXORAddress(t *testing.T) {
+	transactionID := [12]byte{}
+	copy(transactionID[:], decodeHex(t, "b7e7a701bc34d686fa87dfae"))
+
+	tests := []struct {
+		addr    *net.UDPAddr
+		encoded string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853},
+			"0001a147e112a643"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"),
+			Port: 32853}, "0002a1470113a9faa5d3f179bc25f4b5bed2b9d9"},
+	}
+
+	for _, test := range tests {
+		encoded := hex.EncodeToString(encodeXORAddress(test.addr,
+			transactionID))
+		if encoded != test.encoded {
+			t.Errorf("encodeXORAddress(%v) = %s, want %s", test.addr, encoded,
+				test.encoded)
+		}
+		addr, err := decodeXORAddress(decodeHex(t, test.encoded),
+			transactionID)
+		if err != nil || !addr.IP.Equal(test.addr.IP) ||
+			addr.Port != test.addr.Port {
+			t.Errorf("decodeXORAddress(%s) = %v, %v, want %v", test.encoded,
+				addr, err, test.addr)
+		}
+	}
+
+	// Addresses of unknown families or the wrong length are rejected.
+	for _, value := range []string{"", "0001a147", "0003a147e112a643",
+		"0001a147e112a6430000", "0002a147e112a643"} {
+		if _, err := decodeXORAddress(decodeHex(t, value),
+			transactionID); err != errAddressFamily {
+			t.Errorf("decodeXORAddress(%s) error = %v, want %v", value, err,
+				errAddressFamily)
+		}
+	}
+}
+
+// TestEncodeErrorCode checks the class and number of error codes are split.
+func TestEncodeErrorCode(t *testing.T) {
+	value := encodeErrorCode(438, "Stale Nonce")
+	if value[2] != 4 || value[3] != 38 ||
+		!strings.HasSuffix(string(value), "Stale Nonce") {
+		t.Errorf("encodeErrorCode(438) = %x", value)
+	}
+}
@@ -0,0 +1,165 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+// The largest datagram we expect, anything longer is truncated and dropped.
+const maxDatagramSize = 1500
+
+// Statistics are the counters of the STUN server.
+type Statistics struct {
+	Address     string `json:"address"`
+	Requests    uint64 `json:"requests"`
+	Responses   uint64 `json:"responses"`
+	Errors      uint64 `json:"errors"`
+	Indications uint64 `json:"indications"`
+	Malformed   uint64 `json:"malformed"`
+}
+
+// statistics are the counters of the running STUN server, updated atomically.
+var statistics Statistics
+var serverAddress atomic.Value
+
+// knownAttributes are the comprehension-required attributes we understand.
+// Requests with any other comprehension-required attribute are rejected.
+var knownAttributes = map[uint16]bool{
+	attrMappedAddress:    true,
+	attrUsername:         true,
+	attrMessageIntegrity: true,
+	attrErrorCode:        true,
+	attrRealm:            true,
+	attrNonce:            true,
+	attrXORMappedAddress: true,
+}
+
+// GetStatistics returns the counters of the STUN server.
+func GetStatistics() Statistics {
+	address, _ := serverAddress.Load().(string)
+	return Statistics{
+		Address:     address,
+		Requests:    atomic.LoadUint64(&statistics.Requests),
+		Responses:   atomic.LoadUint64(&statistics.Responses),
+		Errors:      atomic.LoadUint64(&statistics.Errors),
+		Indications: atomic.LoadUint64(&statistics.Indications),
+		Malformed:   atomic.LoadUint64(&statistics.Malformed),
+	}
+}
+
+// ListenAndServe listens on the UDP address and answers STUN binding requests
+// until the context is done.
+func ListenAndServe(ctx context.Context, address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	serverAddress.Store(conn.LocalAddr().String())
+
+	// Close the connection once the context is done to stop reading.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Answer each datagram in turn, they're cheap to answer.
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		size, addr, err := conn.ReadFrom(buffer)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		// Responses are best effort, clients retransmit lost requests.
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if response := handleDatagram(buffer[:size], udpAddr); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// handleDatagram handles the datagram received from the address, returning the
+// response to send back, if any.
+func handleDatagram(data []byte, addr *net.UDPAddr) []byte {
+	// Drop anything that isn't a STUN message.
+	request, err := parseMessage(data)
+	if err != nil {
+		atomic.AddUint64(&statistics.Malformed, 1)
+		return nil
+	}
+
+	// Indications are never answered, nor are responses.
+	switch request.class {
+	case classIndication:
+		atomic.AddUint64(&statistics.Indications, 1)
+		return nil
+	case classSuccess, classError:
+		atomic.AddUint64(&statistics.Malformed, 1)
+		return nil
+	}
+	atomic.AddUint64(&statistics.Requests, 1)
+
+	// Only binding requests with attributes we understand are supported.
+	response := rejectUnknownAttributes(request, knownAttributes)
+	if response == nil && request.method != methodBinding {
+		response = errorResponse(request, 400, "Bad Request")
+	} else if response == nil {
+		response = bindingResponse(request, addr)
+	}
+	if response.class == classError {
+		atomic.AddUint64(&statistics.Errors, 1)
+	} else {
+		atomic.AddUint64(&statistics.Responses, 1)
+	}
+
+	return response.encode()
+}
+
+// rejectUnknownAttributes returns an error response to the request if it has
+// any comprehension-required attribute which isn't known, or nil otherwise.
+func rejectUnknownAttributes(request *message, known map[uint16]bool) *message {
+	unknown := []byte{}
+	for _, attr := range request.attributes {
+		if attr.kind < 0x8000 && !known[attr.kind] {
+			kind := make([]byte, 2)
+			binary.BigEndian.PutUint16(kind, attr.kind)
+			unknown = append(unknown, kind...)
+		}
+	}
+	if len(unknown) <= 0 {
+		return nil
+	}
+
+	response := errorResponse(request, 420, "Unknown Attribute")
+	response.add(attrUnknownAttributes, unknown)
+	return response
+}
+
+// bindingResponse creates the response to the binding request, telling the
+// client the address we saw its request coming from.
+func bindingResponse(request *message, addr *net.UDPAddr) *message {
+	response := newResponse(request, classSuccess)
+	response.add(attrXORMappedAddress,
+		encodeXORAddress(addr, request.transactionID))
+
+	return response
+}
+
+// errorResponse creates an error response with the code to the request.
+func errorResponse(request *message, code int, reason string) *message {
+	response := newResponse(request, classError)
+	response.add(attrErrorCode, encodeErrorCode(code, reason))
+
+	return response
+}
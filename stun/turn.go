@@ -0,0 +1,894 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jswirl/miit/logging"
+)
+
+// TURN allocation, permission, channel binding and nonce lifetimes, see RFC
+// 5766.
+const (
+	defaultAllocationLifetime = 10 * time.Minute
+	maxAllocationLifetime     = time.Hour
+	permissionLifetime        = 5 * time.Minute
+	channelLifetime           = 10 * time.Minute
+	nonceLifetime             = time.Hour
+)
+
+// How often expired allocations are released.
+const allocationSweepInterval = 10 * time.Second
+
+// The largest datagram relayed, relayed datagrams may exceed the MTU.
+const maxRelayDatagramSize = 65535
+
+// The largest datagram relayed in a data indication, which must fit in a UDP
+// datagram over IPv4 of at most 65507 bytes: the header, the XOR-PEER-ADDRESS
+// of an IPv6 peer, the DATA header and the FINGERPRINT take 56 bytes, and the
+// data is padded to 4 bytes. This also keeps within the 16-bit message length.
+const maxIndicationDataSize = 65448
+
+// The protocol number of UDP, the only relay transport supported.
+const transportUDP = 17
+
+// The range of channel numbers clients may bind peers to.
+const (
+	minChannelNumber = 0x4000
+	maxChannelNumber = 0x7FFF
+)
+
+// ErrServerClosed is returned by the TURN server after it's been shut down.
+var ErrServerClosed = errors.New("TURN server closed")
+
+// defaultDeniedPeers are the networks clients may not relay to unless they're
+// explicitly allowed, so the relay can't be used to reach the hosts next to
+// it: unspecified, loopback, private, carrier-grade NAT, link-local and
+// multicast addresses.
+var defaultDeniedPeers = mustParseNetworks("0.0.0.0/8,10.0.0.0/8," +
+	"100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12,192.168.0.0/16," +
+	"224.0.0.0/4,255.255.255.255/32,::/128,::1/128,fc00::/7,fe80::/10," +
+	"ff00::/8")
+
+// turnAttributes are the comprehension-required attributes the TURN server
+// understands.
+var turnAttributes = map[uint16]bool{
+	attrMappedAddress:      true,
+	attrUsername:           true,
+	attrMessageIntegrity:   true,
+	attrErrorCode:          true,
+	attrRealm:              true,
+	attrNonce:              true,
+	attrXORMappedAddress:   true,
+	attrChannelNumber:      true,
+	attrLifetime:           true,
+	attrXORPeerAddress:     true,
+	attrData:               true,
+	attrXORRelayedAddress:  true,
+	attrRequestedTransport: true,
+}
+
+// TURNConfig are the configurations of a TURN server.
+type TURNConfig struct {
+	// Address is the UDP address the TURN server listens on.
+	Address string
+	// Realm is the realm of the long-term credentials.
+	Realm string
+	// RelayAddress is the IP address relayed transport addresses are
+	// allocated on, it must be reachable by peers.
+	RelayAddress net.IP
+	// RelayPortMin & RelayPortMax are the range of relay ports.
+	RelayPortMin int
+	RelayPortMax int
+	// MaxAllocations is the number of allocations allowed per credential.
+	MaxAllocations int
+	// Credentials are the passwords of the long-term credentials by user.
+	Credentials map[string]string
+	// Secret is the secret shared with whoever issues ephemeral credentials,
+	// see CreateCredential.
+	Secret string
+	// AllowedPeers are the networks clients may always relay to, and
+	// DeniedPeers those they may never relay to besides the unspecified,
+	// loopback, private, link-local and multicast networks.
+	AllowedPeers []*net.IPNet
+	DeniedPeers  []*net.IPNet
+}
+
+// TURNServer is a TURN server relaying UDP datagrams between its clients and
+// their peers, for clients which can't reach their peers directly.
+type TURNServer struct {
+	config      TURNConfig
+	nonceSecret []byte
+	mutex       sync.Mutex
+	conn        net.PacketConn
+	allocations map[string]*allocation
+	closed      bool
+	done        chan struct{}
+}
+
+// allocation is a relayed transport address allocated for a client, and the
+// peers it may exchange datagrams with.
+type allocation struct {
+	client        *net.UDPAddr
+	username      string
+	relay         net.PacketConn
+	transactionID [12]byte
+	mutex         sync.Mutex
+	expiry        time.Time
+	permissions   map[string]time.Time
+	channels      map[uint16]*channelBinding
+}
+
+// channelBinding is a channel bound to a peer of an allocation.
+type channelBinding struct {
+	peer   *net.UDPAddr
+	expiry time.Time
+}
+
+// CreateCredential creates an ephemeral TURN credential for the user, valid
+// until the expiry. The username is the expiry timestamp and the user ID
+// separated by a colon, and the password its HMAC-SHA1 signature with the
+// shared secret, which is what TURN servers such as coturn expect.
+func CreateCredential(secret string, userID string,
+	expiry time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", expiry.Unix(), userID)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewTURNServer creates a TURN server with the configurations.
+func NewTURNServer(config TURNConfig) *TURNServer {
+	// Nonces are signed with a secret of the instance, so they don't have to
+	// be kept.
+	nonceSecret := make([]byte, 32)
+	if _, err := rand.Read(nonceSecret); err != nil {
+		panic(err)
+	}
+
+	return &TURNServer{
+		config:      config,
+		nonceSecret: nonceSecret,
+		allocations: map[string]*allocation{},
+		done:        make(chan struct{}),
+	}
+}
+
+// Addr returns the address the TURN server listens on.
+func (server *TURNServer) Addr() string {
+	return server.config.Address
+}
+
+// ListenAndServe listens on the UDP address of the TURN server and relays the
+// datagrams of its clients, until the server is shut down.
+func (server *TURNServer) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", server.config.Address)
+	if err != nil {
+		return err
+	}
+
+	// Don't start serving if we've already been shut down.
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	server.conn = conn
+	server.mutex.Unlock()
+
+	// Release expired allocations in the background.
+	go server.sweepAllocations()
+
+	// Handle each datagram in turn.
+	buffer := make([]byte, maxRelayDatagramSize)
+	for {
+		size, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if server.isClosed() {
+				return ErrServerClosed
+			} else if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			server.handleDatagram(buffer[:size], udpAddr)
+		}
+	}
+}
+
+// Shutdown stops the TURN server and releases all its allocations.
+func (server *TURNServer) Shutdown() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closed {
+		return
+	}
+	server.closed = true
+	close(server.done)
+	if server.conn != nil {
+		server.conn.Close()
+	}
+	for key, alloc := range server.allocations {
+		delete(server.allocations, key)
+		alloc.relay.Close()
+	}
+}
+
+// isClosed checks if the TURN server has been shut down.
+func (server *TURNServer) isClosed() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.closed
+}
+
+// handleDatagram handles a datagram received from a client.
+func (server *TURNServer) handleDatagram(data []byte, addr *net.UDPAddr) {
+	// Channel data messages start with a channel number.
+	if len(data) < 4 {
+		return
+	} else if data[0]&0xC0 == 0x40 {
+		server.relayChannelData(data, addr)
+		return
+	}
+
+	// Otherwise drop anything that isn't a STUN message.
+	request, err := parseMessage(data)
+	if err != nil {
+		return
+	}
+
+	// Send indications are relayed, other indications & responses dropped.
+	switch request.class {
+	case classIndication:
+		if request.method == methodSend {
+			server.relaySendIndication(request, addr)
+		}
+		return
+	case classSuccess, classError:
+		return
+	}
+
+	response := server.handleRequest(request, addr)
+	server.conn.WriteTo(response.encode(), addr)
+}
+
+// handleRequest handles a request received from a client, returning the
+// response to it.
+func (server *TURNServer) handleRequest(request *message,
+	addr *net.UDPAddr) *message {
+	// Reject requests with attributes we don't understand.
+	unknown := rejectUnknownAttributes(request, turnAttributes)
+	if unknown != nil {
+		return unknown
+	}
+
+	// Binding requests don't need to be authenticated.
+	if request.method == methodBinding {
+		return bindingResponse(request, addr)
+	}
+
+	// Authenticate requests with the long-term credentials of the user.
+	username, key, response := server.authenticate(request)
+	if response != nil {
+		return response
+	}
+
+	switch request.method {
+	case methodAllocate:
+		response = server.allocate(request, addr, username)
+	case methodRefresh:
+		response = server.refresh(request, addr, username)
+	case methodCreatePermission:
+		response = server.createPermission(request, addr, username)
+	case methodChannelBind:
+		response = server.bindChannel(request, addr, username)
+	default:
+		response = errorResponse(request, 400, "Bad Request")
+	}
+
+	// Sign the response with the key of the user.
+	response.integrityKey = key
+	return response
+}
+
+// authenticate authenticates the request with the long-term credentials of
+// the user, returning the user & key, or the error response challenging the
+// client to authenticate otherwise.
+func (server *TURNServer) authenticate(request *message) (string, []byte,
+	*message) {
+	// Challenge requests without message integrity.
+	if request.integrityOffset < 0 {
+		return "", nil, server.challenge(request, 401, "Unauthorized")
+	}
+	username, hasUsername := request.get(attrUsername)
+	realm, hasRealm := request.get(attrRealm)
+	nonce, hasNonce := request.get(attrNonce)
+	if !hasUsername || !hasRealm || !hasNonce {
+		return "", nil, errorResponse(request, 400, "Bad Request")
+	}
+
+	// Nonces expire, challenge the client again with a fresh nonce.
+	if !server.nonceIsValid(string(nonce)) {
+		return "", nil, server.challenge(request, 438, "Stale Nonce")
+	}
+
+	// Check the message integrity with the key of the user.
+	password, exists := server.password(string(username))
+	key := longTermKey(string(username), server.config.Realm, password)
+	if !exists || string(realm) != server.config.Realm ||
+		!request.checkIntegrity(key) {
+		return "", nil, server.challenge(request, 401, "Unauthorized")
+	}
+
+	return string(username), key, nil
+}
+
+// password returns the password of the user, whether it's a configured user
+// or an unexpired ephemeral credential.
+func (server *TURNServer) password(username string) (string, bool) {
+	if password, exists := server.config.Credentials[username]; exists {
+		return password, true
+	} else if len(server.config.Secret) <= 0 {
+		return "", false
+	}
+
+	// Ephemeral credentials start with their expiry timestamp.
+	fields := strings.SplitN(username, ":", 2)
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	if len(fields) != 2 || err != nil || time.Now().Unix() >= expiry {
+		return "", false
+	}
+	_, password := CreateCredential(server.config.Secret, fields[1],
+		time.Unix(expiry, 0))
+
+	return password, true
+}
+
+// challenge creates an error response with the code to the request, with the
+// realm and a fresh nonce for the client to authenticate with.
+func (server *TURNServer) challenge(request *message, code int,
+	reason string) *message {
+	response := errorResponse(request, code, reason)
+	response.add(attrRealm, []byte(server.config.Realm))
+	response.add(attrNonce, []byte(server.createNonce()))
+
+	return response
+}
+
+// createNonce creates a nonce, which is its expiry signed by the server.
+func (server *TURNServer) createNonce() string {
+	expiry := fmt.Sprintf("%016x", time.Now().Add(nonceLifetime).Unix())
+	return expiry + server.signNonce(expiry)
+}
+
+// nonceIsValid checks if the nonce was signed by the server and hasn't expired.
+func (server *TURNServer) nonceIsValid(nonce string) bool {
+	if len(nonce) != 48 {
+		return false
+	}
+
+	var expiry int64
+	if _, err := fmt.Sscanf(nonce[:16], "%016x", &expiry); err != nil {
+		return false
+	}
+
+	signature := server.signNonce(nonce[:16])
+	return hmac.Equal([]byte(nonce[16:]), []byte(signature)) &&
+		time.Now().Unix() < expiry
+}
+
+// signNonce returns the signature of the nonce expiry.
+func (server *TURNServer) signNonce(expiry string) string {
+	mac := hmac.New(sha256.New, server.nonceSecret)
+	mac.Write([]byte(expiry))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// allocate handles allocate requests, allocating a relayed transport address
+// for the client.
+func (server *TURNServer) allocate(request *message, addr *net.UDPAddr,
+	username string) *message {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	// Clients have one allocation each, answer retransmitted requests again.
+	if alloc, exists := server.allocations[addr.String()]; exists {
+		if alloc.transactionID != request.transactionID ||
+			alloc.username != username {
+			return errorResponse(request, 437, "Allocation Mismatch")
+		}
+		return server.allocateResponse(request, alloc)
+	}
+
+	// Only UDP relays are supported.
+	transport, exists := request.get(attrRequestedTransport)
+	if !exists || len(transport) != 4 {
+		return errorResponse(request, 400, "Bad Request")
+	} else if transport[0] != transportUDP {
+		return errorResponse(request, 442, "Unsupported Transport Protocol")
+	}
+
+	// Enforce the allocation limit of the credential, ephemeral credentials
+	// of the same user count as one.
+	count := 0
+	for _, alloc := range server.allocations {
+		if credentialUser(alloc.username) == credentialUser(username) {
+			count++
+		}
+	}
+	if count >= server.config.MaxAllocations {
+		logging.Warn("TURN allocation quota of [%s] reached", username)
+		return errorResponse(request, 486, "Allocation Quota Reached")
+	}
+
+	// Listen on a relay port.
+	relay, err := server.listenRelay()
+	if err != nil {
+		logging.Error("Failed to allocate TURN relay: %v", err)
+		return errorResponse(request, 508, "Insufficient Capacity")
+	}
+
+	// Create the allocation and start relaying datagrams from peers.
+	alloc := &allocation{
+		client:        addr,
+		username:      username,
+		relay:         relay,
+		transactionID: request.transactionID,
+		expiry:        time.Now().Add(requestedLifetime(request)),
+		permissions:   map[string]time.Time{},
+		channels:      map[uint16]*channelBinding{},
+	}
+	server.allocations[addr.String()] = alloc
+	go server.relayFromPeers(alloc)
+	logging.Info("Allocated TURN relay [%s] to [%s] of [%s]",
+		relay.LocalAddr().String(), addr.String(), username)
+
+	return server.allocateResponse(request, alloc)
+}
+
+// allocateResponse creates the response to the allocate request, telling the
+// client its relayed transport address.
+func (server *TURNServer) allocateResponse(request *message,
+	alloc *allocation) *message {
+	alloc.mutex.Lock()
+	lifetime := time.Until(alloc.expiry)
+	alloc.mutex.Unlock()
+
+	response := bindingResponse(request, alloc.client)
+	response.add(attrXORRelayedAddress, encodeXORAddress(
+		alloc.relay.LocalAddr().(*net.UDPAddr), request.transactionID))
+	response.add(attrLifetime, encodeLifetime(lifetime))
+
+	return response
+}
+
+// refresh handles refresh requests, extending the lifetime of allocations or
+// releasing them if the requested lifetime is zero.
+func (server *TURNServer) refresh(request *message, addr *net.UDPAddr,
+	username string) *message {
+	alloc, response := server.findAllocation(request, addr, username)
+	if response != nil {
+		return response
+	}
+
+	// Release the allocation if asked to, extend it otherwise.
+	lifetime := requestedLifetime(request)
+	if value, exists := request.get(attrLifetime); exists &&
+		len(value) == 4 && binary.BigEndian.Uint32(value) == 0 {
+		server.release(alloc)
+		lifetime = 0
+	} else {
+		alloc.mutex.Lock()
+		alloc.expiry = time.Now().Add(lifetime)
+		alloc.mutex.Unlock()
+	}
+	response = newResponse(request, classSuccess)
+	response.add(attrLifetime, encodeLifetime(lifetime))
+
+	return response
+}
+
+// createPermission handles create permission requests, permitting the peers
+// to exchange datagrams with the client.
+func (server *TURNServer) createPermission(request *message,
+	addr *net.UDPAddr, username string) *message {
+	alloc, response := server.findAllocation(request, addr, username)
+	if response != nil {
+		return response
+	}
+
+	// Decode all peer addresses before installing any permission.
+	peers := []*net.UDPAddr{}
+	for _, attr := range request.attributes {
+		if attr.kind != attrXORPeerAddress {
+			continue
+		}
+		peer, err := decodeXORAddress(attr.value, request.transactionID)
+		if err != nil {
+			return errorResponse(request, 400, "Bad Request")
+		} else if !server.isAllowedPeer(peer.IP) {
+			return errorResponse(request, 403, "Forbidden")
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) <= 0 {
+		return errorResponse(request, 400, "Bad Request")
+	}
+
+	// Install or refresh the permissions.
+	alloc.mutex.Lock()
+	defer alloc.mutex.Unlock()
+	for _, peer := range peers {
+		alloc.permissions[peer.IP.String()] =
+			time.Now().Add(permissionLifetime)
+	}
+
+	return newResponse(request, classSuccess)
+}
+
+// bindChannel handles channel bind requests, binding a channel to a peer and
+// permitting the peer to exchange datagrams with the client.
+func (server *TURNServer) bindChannel(request *message, addr *net.UDPAddr,
+	username string) *message {
+	alloc, response := server.findAllocation(request, addr, username)
+	if response != nil {
+		return response
+	}
+
+	// Check the channel number and the peer address.
+	value, exists := request.get(attrChannelNumber)
+	if !exists || len(value) != 4 {
+		return errorResponse(request, 400, "Bad Request")
+	}
+	number := binary.BigEndian.Uint16(value[0:2])
+	value, exists = request.get(attrXORPeerAddress)
+	if !exists || number < minChannelNumber || number > maxChannelNumber {
+		return errorResponse(request, 400, "Bad Request")
+	}
+	peer, err := decodeXORAddress(value, request.transactionID)
+	if err != nil {
+		return errorResponse(request, 400, "Bad Request")
+	} else if !server.isAllowedPeer(peer.IP) {
+		return errorResponse(request, 403, "Forbidden")
+	}
+
+	// Channels & peers can't be bound to others while they're bound.
+	alloc.mutex.Lock()
+	defer alloc.mutex.Unlock()
+	now := time.Now()
+	for bound, binding := range alloc.channels {
+		samePeer := binding.peer.IP.Equal(peer.IP) &&
+			binding.peer.Port == peer.Port
+		if now.Before(binding.expiry) && (bound == number) != samePeer {
+			return errorResponse(request, 400, "Bad Request")
+		}
+	}
+
+	// Bind or refresh the channel, which also installs a permission.
+	alloc.channels[number] = &channelBinding{
+		peer:   peer,
+		expiry: now.Add(channelLifetime),
+	}
+	alloc.permissions[peer.IP.String()] = now.Add(permissionLifetime)
+
+	return newResponse(request, classSuccess)
+}
+
+// findAllocation returns the allocation of the client, or the error response
+// to the request if it has none or it's allocated to another user.
+func (server *TURNServer) findAllocation(request *message, addr *net.UDPAddr,
+	username string) (*allocation, *message) {
+	server.mutex.Lock()
+	alloc, exists := server.allocations[addr.String()]
+	server.mutex.Unlock()
+	if !exists {
+		return nil, errorResponse(request, 437, "Allocation Mismatch")
+	} else if alloc.username != username {
+		return nil, errorResponse(request, 441, "Wrong Credentials")
+	}
+
+	return alloc, nil
+}
+
+// relaySendIndication relays the data of a send indication to its peer.
+func (server *TURNServer) relaySendIndication(indication *message,
+	addr *net.UDPAddr) {
+	server.mutex.Lock()
+	alloc, exists := server.allocations[addr.String()]
+	server.mutex.Unlock()
+	if !exists {
+		return
+	}
+
+	// Only relay to permitted peers.
+	value, hasPeer := indication.get(attrXORPeerAddress)
+	data, hasData := indication.get(attrData)
+	if !hasPeer || !hasData {
+		return
+	}
+	peer, err := decodeXORAddress(value, indication.transactionID)
+	if err != nil || !server.isAllowedPeer(peer.IP) ||
+		!alloc.isPermitted(peer.IP) {
+		return
+	}
+
+	alloc.relay.WriteTo(data, peer)
+}
+
+// relayChannelData relays the data of a channel data message to the peer
+// bound to its channel.
+func (server *TURNServer) relayChannelData(data []byte, addr *net.UDPAddr) {
+	server.mutex.Lock()
+	alloc, exists := server.allocations[addr.String()]
+	server.mutex.Unlock()
+	if !exists || len(data) < 4 {
+		return
+	}
+
+	// Find the peer bound to the channel.
+	number := binary.BigEndian.Uint16(data[0:2])
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if 4+length > len(data) {
+		return
+	}
+	alloc.mutex.Lock()
+	binding, bound := alloc.channels[number]
+	alloc.mutex.Unlock()
+	if !bound || time.Now().After(binding.expiry) ||
+		!alloc.isPermitted(binding.peer.IP) {
+		return
+	}
+
+	alloc.relay.WriteTo(data[4:4+length], binding.peer)
+}
+
+// relayFromPeers relays the datagrams received from permitted peers on the
+// relayed transport address to the client, until the allocation is released.
+func (server *TURNServer) relayFromPeers(alloc *allocation) {
+	buffer := make([]byte, maxRelayDatagramSize)
+	for {
+		size, addr, err := alloc.relay.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		peer, ok := addr.(*net.UDPAddr)
+		if !ok || !alloc.isPermitted(peer.IP) {
+			continue
+		}
+
+		// Send the datagram over the channel bound to the peer, if any.
+		if number, bound := alloc.channelOf(peer); bound {
+			frame := make([]byte, 4+size)
+			binary.BigEndian.PutUint16(frame[0:2], number)
+			binary.BigEndian.PutUint16(frame[2:4], uint16(size))
+			copy(frame[4:], buffer[:size])
+			server.conn.WriteTo(frame, alloc.client)
+			continue
+		}
+
+		// Send it in a data indication otherwise, if it fits in one.
+		if size > maxIndicationDataSize {
+			continue
+		}
+		indication := &message{method: methodData, class: classIndication}
+		rand.Read(indication.transactionID[:])
+		indication.add(attrXORPeerAddress,
+			encodeXORAddress(peer, indication.transactionID))
+		indication.add(attrData, buffer[:size])
+		server.conn.WriteTo(indication.encode(), alloc.client)
+	}
+}
+
+// sweepAllocations releases expired allocations periodically, until the
+// server is shut down.
+func (server *TURNServer) sweepAllocations() {
+	ticker := time.NewTicker(allocationSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-server.done:
+			return
+		case now := <-ticker.C:
+			server.mutex.Lock()
+			expired := []*allocation{}
+			for _, alloc := range server.allocations {
+				alloc.mutex.Lock()
+				if now.After(alloc.expiry) {
+					expired = append(expired, alloc)
+				}
+				alloc.mutex.Unlock()
+			}
+			server.mutex.Unlock()
+			for _, alloc := range expired {
+				server.release(alloc)
+			}
+		}
+	}
+}
+
+// release releases the allocation, closing its relayed transport address.
+func (server *TURNServer) release(alloc *allocation) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	key := alloc.client.String()
+	if server.allocations[key] != alloc {
+		return
+	}
+	delete(server.allocations, key)
+	alloc.relay.Close()
+	logging.Info("Released TURN relay [%s] of [%s]",
+		alloc.relay.LocalAddr().String(), alloc.username)
+}
+
+// listenRelay listens on a free port within the relay port range, starting
+// from a random one so ports aren't reused right away.
+func (server *TURNServer) listenRelay() (net.PacketConn, error) {
+	min, max := server.config.RelayPortMin, server.config.RelayPortMax
+	ports := max - min + 1
+	if ports <= 0 {
+		return nil, errors.New("empty relay port range")
+	}
+
+	start := mathrand.Intn(ports)
+	for idx := 0; idx < ports; idx++ {
+		addr := &net.UDPAddr{
+			IP:   server.config.RelayAddress,
+			Port: min + (start+idx)%ports,
+		}
+		if relay, err := net.ListenUDP("udp", addr); err == nil {
+			return relay, nil
+		}
+	}
+
+	return nil, errors.New("no relay port available")
+}
+
+// isAllowedPeer checks if clients may relay to the peer at all, whatever
+// permissions they install.
+func (server *TURNServer) isAllowedPeer(ip net.IP) bool {
+	if containsIP(server.config.AllowedPeers, ip) {
+		return true
+	}
+
+	return !containsIP(server.config.DeniedPeers, ip) &&
+		!containsIP(defaultDeniedPeers, ip)
+}
+
+// isPermitted checks if the peer has a permission to exchange datagrams with
+// the client.
+func (alloc *allocation) isPermitted(ip net.IP) bool {
+	alloc.mutex.Lock()
+	defer alloc.mutex.Unlock()
+
+	expiry, exists := alloc.permissions[ip.String()]
+	return exists && time.Now().Before(expiry)
+}
+
+// channelOf returns the channel bound to the peer, if any.
+func (alloc *allocation) channelOf(peer *net.UDPAddr) (uint16, bool) {
+	alloc.mutex.Lock()
+	defer alloc.mutex.Unlock()
+
+	now := time.Now()
+	for number, binding := range alloc.channels {
+		if binding.peer.IP.Equal(peer.IP) && binding.peer.Port == peer.Port &&
+			now.Before(binding.expiry) {
+			return number, true
+		}
+	}
+
+	return 0, false
+}
+
+// credentialUser returns the user of the credential, which is the username
+// without the expiry timestamp for ephemeral credentials.
+func credentialUser(username string) string {
+	fields := strings.SplitN(username, ":", 2)
+	if _, err := strconv.ParseInt(fields[0], 10, 64); err == nil &&
+		len(fields) == 2 {
+		return fields[1]
+	}
+
+	return username
+}
+
+// requestedLifetime returns the lifetime requested for an allocation, within
+// the default and maximum lifetime.
+func requestedLifetime(request *message) time.Duration {
+	lifetime := defaultAllocationLifetime
+	value, exists := request.get(attrLifetime)
+	if exists && len(value) == 4 {
+		lifetime = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+	}
+	if lifetime < defaultAllocationLifetime {
+		lifetime = defaultAllocationLifetime
+	} else if lifetime > maxAllocationLifetime {
+		lifetime = maxAllocationLifetime
+	}
+
+	return lifetime
+}
+
+// encodeLifetime encodes the lifetime in seconds, as in LIFETIME attributes.
+func encodeLifetime(lifetime time.Duration) []byte {
+	value := make([]byte, 4)
+	if lifetime > 0 {
+		binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	}
+
+	return value
+}
+
+// ParseNetworks parses a comma separated list of networks in CIDR notation, or
+// single IP addresses.
+func ParseNetworks(value string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) <= 0 {
+			continue
+		}
+
+		// Single addresses are networks of their own.
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: [%s]", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// mustParseNetworks parses a comma separated list of networks, panicking if
+// any of them is invalid.
+func mustParseNetworks(value string) []*net.IPNet {
+	networks, err := ParseNetworks(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return networks
+}
+
+// containsIP checks if any of the networks contains the IP address.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+// TestIsAllowedPeer checks which peers clients may relay to, by default and
+// with networks explicitly allowed or denied.
+func TestIsAllowedPeer(t *testing.T) {
+	server := &TURNServer{config: TURNConfig{
+		AllowedPeers: mustParseNetworks("10.1.0.0/16,fd00::1"),
+		DeniedPeers:  mustParseNetworks("203.0.113.0/24"),
+	}}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		// Public addresses are allowed.
+		{"8.8.8.8", true},
+		{"100.128.0.1", true},
+		{"2001:4860:4860::8888", true},
+		// Special purpose addresses are denied by default.
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"10.0.0.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"::ffff:10.0.0.1", false},
+		// Explicitly allowed networks take precedence over denied ones.
+		{"10.1.2.3", true},
+		{"fd00::1", true},
+		{"fd00::2", false},
+		// Explicitly denied networks are denied too.
+		{"203.0.113.7", false},
+	}
+
+	for _, test := range tests {
+		if allowed := server.isAllowedPeer(net.ParseIP(test.ip)); allowed !=
+			test.allowed {
+			t.Errorf("isAllowedPeer(%s) = %v, want %v", test.ip, allowed,
+				test.allowed)
+		}
+	}
+}